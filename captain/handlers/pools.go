@@ -2,6 +2,7 @@ package handlers
 
 import (
 	"net/http"
+	"strings"
 
 	"github.com/gin-gonic/gin"
 	"github.com/pubudu2003060/go-proxy-prototype/captain/models"
@@ -19,9 +20,20 @@ func CreatePool(storage *storage.MemoryStorage) gin.HandlerFunc {
 		pool := &models.Pool{
 			Name:      req.Name,
 			Region:    req.Region,
+			Tag:       req.Tag,
 			Subdomain: req.Subdomain,
-			Port:      req.Port,
+			CC3:       req.CC3,
+			PortStart: req.PortStart,
+			PortEnd:   req.PortEnd,
+			Flag:      req.Flag,
 			Outs:      req.Outs,
+			Provider:  req.Provider,
+			Strategy:  req.Strategy,
+		}
+
+		if err := pool.Validate(); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
 		}
 
 		if err := storage.CreatePool(pool); err != nil {
@@ -69,21 +81,48 @@ func UpdatePool(storage *storage.MemoryStorage) gin.HandlerFunc {
 		}
 
 		if err := storage.UpdatePool(name, func(pool *models.Pool) error {
+			updated := *pool
 			if req.Region != nil {
-				pool.Region = *req.Region
+				updated.Region = *req.Region
+			}
+			if req.Tag != nil {
+				updated.Tag = *req.Tag
 			}
 			if req.Outs != nil {
-				pool.Outs = *req.Outs
+				updated.Outs = *req.Outs
+			}
+			if req.PortStart != nil {
+				updated.PortStart = *req.PortStart
 			}
-			if req.Port != nil {
-				pool.Port = *req.Port
+			if req.PortEnd != nil {
+				updated.PortEnd = *req.PortEnd
 			}
 			if req.Subdomain != nil {
-				pool.Subdomain = *req.Subdomain
+				updated.Subdomain = *req.Subdomain
+			}
+			if req.CC3 != nil {
+				updated.CC3 = *req.CC3
 			}
+			if req.Flag != nil {
+				updated.Flag = *req.Flag
+			}
+			if req.Provider != nil {
+				updated.Provider = *req.Provider
+			}
+			if req.Strategy != nil {
+				updated.Strategy = *req.Strategy
+			}
+			if err := updated.Validate(); err != nil {
+				return err
+			}
+			*pool = updated
 			return nil
 		}); err != nil {
-			c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+			if strings.Contains(err.Error(), "not found") {
+				c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+				return
+			}
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 			return
 		}
 
@@ -123,6 +123,31 @@ func DeleteUser(storage *storage.MemoryStorage) gin.HandlerFunc {
 	}
 }
 
+func ListUserSessions(storage *storage.MemoryStorage) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		sessions, err := storage.UserSessions(c.Param("id"))
+		if err != nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+			return
+		}
+
+		c.JSON(http.StatusOK, sessions)
+	}
+}
+
+// KillUserSession makes every worker drop the session and close its
+// connections, so the next request with it gets a fresh exit.
+func KillUserSession(storage *storage.MemoryStorage) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if err := storage.KillSession(c.Param("id"), c.Param("sid")); err != nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{"message": "Session killed"})
+	}
+}
+
 func Generate(storage *storage.MemoryStorage) gin.HandlerFunc {
 	return func(c *gin.Context) {
 		var generateRequest models.GenerateRequest
@@ -156,7 +181,7 @@ func Generate(storage *storage.MemoryStorage) gin.HandlerFunc {
 		}
 
 		for _, p := range region.Pools {
-			if strings.Contains(p.Name, generateRequest.UpStream) {
+			if p.Provider == generateRequest.UpStream || strings.Contains(p.Name, generateRequest.UpStream) {
 				pool = &p
 				break
 			}
@@ -180,9 +205,24 @@ func Generate(storage *storage.MemoryStorage) gin.HandlerFunc {
 			return
 		}
 
-		filters := utils.GetFilters(generateRequest.UpStream, country.Code, generateRequest.IsSticky)
+		rotation := generateRequest.Rotation
+		if rotation == "" {
+			rotation = models.RotationPerRequest
+			if generateRequest.IsSticky {
+				rotation = models.RotationSticky
+			}
+		}
+
+		filters, err := utils.GetFilters(pool.Provider, country.Code, rotation,
+			time.Duration(generateRequest.Lifetime)*time.Minute,
+			time.Duration(generateRequest.RotateEvery)*time.Minute,
+			user.Id, storage.ReserveSession)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
 
-		s := pool.Subdomain + ".proxies.com:" + strconv.Itoa(pool.Port) + ":" + user.Username + ":" + user.Password + filters
+		s := pool.Subdomain + ".proxies.com:" + strconv.Itoa(pool.PortStart) + ":" + user.Username + ":" + user.Password + filters
 
 		c.JSON(http.StatusOK, struct {
 			Proxy string `json:"proxy"`
@@ -1,25 +1,118 @@
 package handlers
 
 import (
+	"io"
 	"net/http"
+	"strconv"
+	"time"
 
 	"github.com/gin-gonic/gin"
 	"github.com/pubudu2003060/go-proxy-prototype/captain/models"
 	"github.com/pubudu2003060/go-proxy-prototype/captain/storage"
+	"github.com/pubudu2003060/go-proxy-prototype/schema"
 )
 
+// WorkerNameHeader identifies the calling worker on worker endpoints.
+const WorkerNameHeader = "X-Worker-Name"
+
+// WorkerTokenHeader carries the token captain issued to the calling worker.
+const WorkerTokenHeader = "X-Worker-Token"
+
+// authenticateWorker answers 403 and returns false unless the request
+// carries the token of the worker called name.
+func authenticateWorker(c *gin.Context, storage *storage.MemoryStorage, name string) bool {
+	if err := storage.AuthenticateWorker(name, c.GetHeader(WorkerTokenHeader)); err != nil {
+		c.JSON(http.StatusForbidden, gin.H{"error": err.Error()})
+		return false
+	}
+	return true
+}
+
+// GetConfig returns only the pools assigned to the calling worker.
 func GetConfig(storage *storage.MemoryStorage) gin.HandlerFunc {
 	return func(c *gin.Context) {
-		pools, err := storage.GetAllPools()
+		name := c.GetHeader(WorkerNameHeader)
+		if name == "" {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "missing " + WorkerNameHeader + " header"})
+			return
+		}
+		if !authenticateWorker(c, storage, name) {
+			return
+		}
+
+		pools, version, err := storage.GetWorkerConfig(name)
 		if err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			c.JSON(http.StatusForbidden, gin.H{"error": err.Error()})
+			return
+		}
+
+		etag := configETag(version)
+		c.Header("ETag", etag)
+		c.Header("X-Config-Version", strconv.FormatInt(version, 10))
+
+		if c.GetHeader("If-None-Match") == etag {
+			c.Status(http.StatusNotModified)
 			return
 		}
-		
-		c.JSON(http.StatusOK, pools)
+
+		c.JSON(http.StatusOK, schema.NewConfig(version, pools))
 	}
 }
 
+// StreamConfig pushes config events to a worker over SSE. A ping with the
+// current version is sent periodically so a worker that missed an event
+// still notices the change.
+func StreamConfig(storage *storage.MemoryStorage) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		name := c.GetHeader(WorkerNameHeader)
+		if name == "" {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "missing " + WorkerNameHeader + " header"})
+			return
+		}
+		if !authenticateWorker(c, storage, name) {
+			return
+		}
+
+		version, err := storage.WorkerConfigVersion(name)
+		if err != nil {
+			c.JSON(http.StatusForbidden, gin.H{"error": err.Error()})
+			return
+		}
+
+		events, cancel := storage.Subscribe(name)
+		defer cancel()
+
+		ticker := time.NewTicker(15 * time.Second)
+		defer ticker.Stop()
+
+		c.Header("Cache-Control", "no-cache")
+		c.Header("Connection", "keep-alive")
+		c.SSEvent(models.EventPing, models.ConfigEvent{Type: models.EventPing, Version: version})
+		c.Writer.Flush()
+
+		c.Stream(func(w io.Writer) bool {
+			select {
+			case event := <-events:
+				c.SSEvent(event.Type, event)
+				return true
+			case <-ticker.C:
+				version, err := storage.WorkerConfigVersion(name)
+				if err != nil {
+					return false
+				}
+				c.SSEvent(models.EventPing, models.ConfigEvent{Type: models.EventPing, Version: version})
+				return true
+			case <-c.Request.Context().Done():
+				return false
+			}
+		})
+	}
+}
+
+func configETag(version int64) string {
+	return `"` + strconv.FormatInt(version, 10) + `"`
+}
+
 func AuthenticateUser(storage *storage.MemoryStorage) gin.HandlerFunc {
 	return func(c *gin.Context) {
 		var req models.AuthRequest
@@ -27,7 +120,7 @@ func AuthenticateUser(storage *storage.MemoryStorage) gin.HandlerFunc {
 			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 			return
 		}
-		
+
 		user, err := storage.GetUserByUsername(req.Username)
 		if err != nil {
 			c.JSON(http.StatusOK, models.AuthResponse{
@@ -36,7 +129,7 @@ func AuthenticateUser(storage *storage.MemoryStorage) gin.HandlerFunc {
 			})
 			return
 		}
-		
+
 		// Simple password check - in production, use hashed passwords
 		if user.Password != req.Password {
 			c.JSON(http.StatusOK, models.AuthResponse{
@@ -45,7 +138,7 @@ func AuthenticateUser(storage *storage.MemoryStorage) gin.HandlerFunc {
 			})
 			return
 		}
-		
+
 		if user.Status != "active" {
 			c.JSON(http.StatusOK, models.AuthResponse{
 				Success: false,
@@ -53,7 +146,7 @@ func AuthenticateUser(storage *storage.MemoryStorage) gin.HandlerFunc {
 			})
 			return
 		}
-		
+
 		c.JSON(http.StatusOK, models.AuthResponse{
 			Success:      true,
 			UserID:       user.Id,
@@ -71,17 +164,12 @@ func ReportUsage(storage *storage.MemoryStorage) gin.HandlerFunc {
 			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 			return
 		}
-		
-		err := storage.UpdateUser(req.UserID, func(user *models.User) error {
-			user.DataUsed += req.Bytes
-			return nil
-		})
-		
-		if err != nil {
+
+		if err := storage.AddDataUsed(req.UserID, req.Bytes); err != nil {
 			c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
 			return
 		}
-		
+
 		c.JSON(http.StatusOK, gin.H{"message": "Usage reported"})
 	}
-}
\ No newline at end of file
+}
@@ -0,0 +1,154 @@
+package handlers
+
+import (
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/pubudu2003060/go-proxy-prototype/captain/models"
+	"github.com/pubudu2003060/go-proxy-prototype/captain/storage"
+)
+
+func CreateWorker(storage *storage.MemoryStorage) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var req models.CreateWorkerRequest
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		worker := &models.Worker{
+			Name:       req.Name,
+			SubDomains: req.SubDomains,
+			Token:      req.Token,
+		}
+
+		if err := storage.CreateWorker(worker); err != nil {
+			c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+			return
+		}
+
+		c.JSON(http.StatusCreated, models.CreateWorkerResponse{Worker: worker, Token: worker.Token})
+	}
+}
+
+func ListWorkers(storage *storage.MemoryStorage) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		workers, err := storage.ListWorkers()
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+
+		c.JSON(http.StatusOK, workers)
+	}
+}
+
+func GetWorker(storage *storage.MemoryStorage) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		name := c.Param("name")
+
+		worker, err := storage.GetWorker(name)
+		if err != nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+			return
+		}
+
+		c.JSON(http.StatusOK, worker)
+	}
+}
+
+func UpdateWorker(storage *storage.MemoryStorage) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		name := c.Param("name")
+		var req models.UpdateWorkerRequest
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		if req.Token != nil && *req.Token == "" {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "token must not be empty"})
+			return
+		}
+
+		if err := storage.UpdateWorker(name, func(worker *models.Worker) error {
+			if req.SubDomains != nil {
+				worker.SubDomains = *req.SubDomains
+			}
+			if req.Token != nil {
+				worker.Token = *req.Token
+			}
+			return nil
+		}); err != nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+			return
+		}
+
+		worker, _ := storage.GetWorker(name)
+		c.JSON(http.StatusOK, worker)
+	}
+}
+
+func DeleteWorker(storage *storage.MemoryStorage) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		name := c.Param("name")
+
+		if err := storage.DeleteWorker(name); err != nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{"message": "Worker deleted"})
+	}
+}
+
+func RegisterWorker(storage *storage.MemoryStorage) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var req models.RegisterRequest
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		if !authenticateWorker(c, storage, req.Name) {
+			return
+		}
+
+		worker, err := storage.RegisterWorker(&req)
+		if err != nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+			return
+		}
+
+		c.JSON(http.StatusOK, worker)
+	}
+}
+
+func WorkerHeartbeat(storage *storage.MemoryStorage) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var req models.HeartbeatRequest
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		if !authenticateWorker(c, storage, req.Name) {
+			return
+		}
+
+		if err := storage.RecordHeartbeat(&req); err != nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+			return
+		}
+
+		c.JSON(http.StatusOK, models.HeartbeatResponse{
+			Message:        "Heartbeat recorded",
+			KilledSessions: storage.KilledSessions(),
+		})
+	}
+}
+
+func WorkersStatus(storage *storage.MemoryStorage) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		c.JSON(http.StatusOK, storage.WorkerStatuses())
+	}
+}
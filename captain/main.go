@@ -16,6 +16,9 @@ func main() {
 
 	initSampleData(storage)
 
+	go watchWorkers(storage, 30*time.Second)
+	go pruneSessions(storage, time.Minute)
+
 	r := gin.Default()
 
 	// User management
@@ -25,6 +28,8 @@ func main() {
 	r.PUT("/api/v1/users/:id", handlers.UpdateUser(storage))
 	r.DELETE("/api/v1/users/:id", handlers.DeleteUser(storage))
 	r.POST("/api/v1/users/proxy-string", handlers.Generate(storage))
+	r.GET("/api/v1/users/:id/sessions", handlers.ListUserSessions(storage))
+	r.DELETE("/api/v1/users/:id/sessions/:sid", handlers.KillUserSession(storage))
 
 	// Pool management
 	r.POST("/api/v1/pools", handlers.CreatePool(storage))
@@ -33,10 +38,21 @@ func main() {
 	r.PUT("/api/v1/pools/:name", handlers.UpdatePool(storage))
 	r.DELETE("/api/v1/pools/:name", handlers.DeletePool(storage))
 
+	// Worker management
+	r.POST("/api/v1/workers", handlers.CreateWorker(storage))
+	r.GET("/api/v1/workers", handlers.ListWorkers(storage))
+	r.GET("/api/v1/workers/status", handlers.WorkersStatus(storage))
+	r.GET("/api/v1/workers/:name", handlers.GetWorker(storage))
+	r.PUT("/api/v1/workers/:name", handlers.UpdateWorker(storage))
+	r.DELETE("/api/v1/workers/:name", handlers.DeleteWorker(storage))
+
 	// Worker endpoints
 	r.GET("/api/v1/config", handlers.GetConfig(storage))
+	r.GET("/api/v1/config/stream", handlers.StreamConfig(storage))
 	r.POST("/api/v1/auth", handlers.AuthenticateUser(storage))
 	r.POST("/api/v1/usage", handlers.ReportUsage(storage))
+	r.POST("/api/v1/workers/register", handlers.RegisterWorker(storage))
+	r.POST("/api/v1/workers/heartbeat", handlers.WorkerHeartbeat(storage))
 
 	// Health check
 	r.GET("/health", func(c *gin.Context) {
@@ -48,6 +64,29 @@ func main() {
 
 }
 
+// watchWorkers marks workers offline once they miss heartbeats for longer
+// than timeout.
+func watchWorkers(storage *storage.MemoryStorage, timeout time.Duration) {
+	ticker := time.NewTicker(timeout / 3)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		for _, name := range storage.MarkOfflineWorkers(timeout) {
+			log.Printf("Worker %s missed heartbeats, marked offline", name)
+		}
+	}
+}
+
+// pruneSessions drops expired session reservations every interval.
+func pruneSessions(storage *storage.MemoryStorage, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		storage.PruneSessions()
+	}
+}
+
 func initSampleData(storage *storage.MemoryStorage) {
 	// Create sample users
 	storage.CreateUser(&models.User{
@@ -103,12 +142,15 @@ func initSampleData(storage *storage.MemoryStorage) {
 	//netnut - USERNAME-res-nl:PASSWORD-sid-947045456@gw.netnut.net:5959
 	netnutasia := models.Pool{
 		Name:      "netnutasia",
+		Provider:  "netnut",
 		Region:    "asia",
 		Subdomain: "netnutasia.x",
-		Port:      6000,
+		PortStart: 6000,
+		PortEnd:   6000,
 		Outs: []models.Out{
 			{
-				Format:       "cFAPhxyG:9dgbjKKV-%s",
+				Username:     "cFAPhxyG",
+				Password:     "9dgbjKKV",
 				UpstreamPort: 6502,
 				Domain:       "netnutasia.x.proxiess.com",
 				Weight:       100,
@@ -119,11 +161,14 @@ func initSampleData(storage *storage.MemoryStorage) {
 
 	iproyalasia := models.Pool{
 		Name:      "iproyalasia",
+		Provider:  "iproyal",
 		Subdomain: "iproyalasia.x",
-		Port:      6000,
+		PortStart: 6000,
+		PortEnd:   6000,
 		Outs: []models.Out{
 			{
-				Format:       "otJhMuv0:5uhhT0Ds-%s",
+				Username:     "otJhMuv0",
+				Password:     "5uhhT0Ds",
 				UpstreamPort: 12322,
 				Domain:       "iproyalasia.x.proxiess.com",
 				Weight:       100,
@@ -134,11 +179,14 @@ func initSampleData(storage *storage.MemoryStorage) {
 
 	netnuteu := models.Pool{
 		Name:      "netnuteu",
+		Provider:  "netnut",
 		Subdomain: "netnuteu.x",
-		Port:      6000,
+		PortStart: 6000,
+		PortEnd:   6000,
 		Outs: []models.Out{
 			{
-				Format:       "cFAPhxyG:9dgbjKKV-%s",
+				Username:     "cFAPhxyG",
+				Password:     "9dgbjKKV",
 				UpstreamPort: 6501,
 				Domain:       "netnuteu.x.proxiess.com",
 				Weight:       100,
@@ -149,11 +197,14 @@ func initSampleData(storage *storage.MemoryStorage) {
 
 	iproyaleu := models.Pool{
 		Name:      "iproyaleu",
+		Provider:  "iproyal",
 		Subdomain: "iproyaleu.x",
-		Port:      6000,
+		PortStart: 6000,
+		PortEnd:   6000,
 		Outs: []models.Out{
 			{
-				Format:       "otJhMuv0:5uhhT0Ds-%s",
+				Username:     "otJhMuv0",
+				Password:     "5uhhT0Ds",
 				UpstreamPort: 12323,
 				Domain:       "iproyaleu.x.proxiess.com",
 				Weight:       100,
@@ -164,11 +215,14 @@ func initSampleData(storage *storage.MemoryStorage) {
 
 	netnutamerica := models.Pool{
 		Name:      "netnutamerica",
+		Provider:  "netnut",
 		Subdomain: "netnutamerica.x",
-		Port:      6000,
+		PortStart: 6000,
+		PortEnd:   6000,
 		Outs: []models.Out{
 			{
-				Format:       "cFAPhxyG:9dgbjKKV-%s",
+				Username:     "cFAPhxyG",
+				Password:     "9dgbjKKV",
 				UpstreamPort: 6500,
 				Domain:       "netnut.x.proxiess.com",
 				Weight:       100,
@@ -180,11 +234,14 @@ func initSampleData(storage *storage.MemoryStorage) {
 
 	iproyalamerica := models.Pool{
 		Name:      "iproyalamerica",
+		Provider:  "iproyal",
 		Subdomain: "iproyalamerica.x",
-		Port:      6000,
+		PortStart: 6000,
+		PortEnd:   6000,
 		Outs: []models.Out{
 			{
-				Format:       "otJhMuv0:5uhhT0Ds-%s",
+				Username:     "otJhMuv0",
+				Password:     "5uhhT0Ds",
 				UpstreamPort: 12321,
 				Domain:       "iproyal.x.proxiess.com",
 				Weight:       100,
@@ -196,16 +253,19 @@ func initSampleData(storage *storage.MemoryStorage) {
 
 	worker1 := models.Worker{
 		Name:       "asia",
+		Token:      "asia-secret",
 		SubDomains: []string{"iproyalamerica.x", "netnutamerica.x"},
 	}
 
 	worker2 := models.Worker{
 		Name:       "eu",
+		Token:      "eu-secret",
 		SubDomains: []string{"iproyalasia.x", "netnutasia.x"},
 	}
 
 	worker3 := models.Worker{
 		Name:       "america",
+		Token:      "america-secret",
 		SubDomains: []string{"iproyaleu.x", "netnuteu.x"},
 	}
 
@@ -0,0 +1,20 @@
+package models
+
+const (
+	EventPools = "pools"
+	EventUser  = "user"
+	EventPing  = "ping"
+	// EventKillSession asks workers to drop a user's sticky session and
+	// close its connections.
+	EventKillSession = "kill_session"
+)
+
+// ConfigEvent is pushed to workers subscribed to the config stream.
+type ConfigEvent struct {
+	Type    string `json:"type"`
+	Version int64  `json:"version"`
+	UserID  string `json:"user_id,omitempty"`
+	Session string `json:"session,omitempty"`
+	// Generation is the killed session's generation after the kill.
+	Generation int `json:"generation,omitempty"`
+}
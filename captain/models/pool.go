@@ -1,5 +1,7 @@
 package models
 
+import "github.com/pubudu2003060/go-proxy-prototype/schema"
+
 type Country struct {
 	Name string
 	Code string
@@ -11,37 +13,33 @@ type Region struct {
 	Pools     []Pool
 }
 
-type Worker struct {
-	Name       string
-	SubDomains []string
-}
+type Pool = schema.Pool
 
-type Pool struct {
-	Name      string `json:"name"`
-	Region    string `json:"region"`
-	Subdomain string `json:"subdomain"`
-	Port      int    `json:"port"`
-	Outs      []Out  `json:"outs"`
-}
-
-type Out struct {
-	Format       string `json:"format"`
-	UpstreamPort int    `json:"upstream_port"`
-	Domain       string `json:"domain"`
-	Weight       int    `json:"weight"`
-}
+type Out = schema.Out
 
 type CreatePoolRequest struct {
 	Name      string `json:"name" binding:"required"`
 	Region    string `json:"region" binding:"required"`
+	Tag       string `json:"tag"`
 	Subdomain string `json:"subdomain" binding:"required"`
-	Port      int    `json:"port" binding:"required"`
+	CC3       string `json:"cc3"`
+	PortStart int    `json:"port_start" binding:"required"`
+	PortEnd   int    `json:"port_end" binding:"required"`
+	Flag      int    `json:"flag"`
 	Outs      []Out  `json:"outs" binding:"required"`
+	Provider  string `json:"provider"`
+	Strategy  string `json:"strategy"`
 }
 
 type UpdatePoolRequest struct {
 	Region    *string `json:"region,omitempty" `
+	Tag       *string `json:"tag,omitempty"`
 	Subdomain *string `json:"subdomain,omitempty"`
-	Port      *int    `json:"port,omitempty"`
+	CC3       *string `json:"cc3,omitempty"`
+	PortStart *int    `json:"port_start,omitempty"`
+	PortEnd   *int    `json:"port_end,omitempty"`
+	Flag      *int    `json:"flag,omitempty"`
 	Outs      *[]Out  `json:"outs,omitempty"`
+	Provider  *string `json:"provider,omitempty"`
+	Strategy  *string `json:"strategy,omitempty"`
 }
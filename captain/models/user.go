@@ -50,9 +50,37 @@ type UsageReport struct {
 	Bytes  int64  `json:"bytes" binding:"required"`
 }
 
+// Rotation modes of generated credentials.
+const (
+	RotationSticky     = "sticky"
+	RotationPerRequest = "per_request"
+	RotationInterval   = "interval"
+)
+
 type GenerateRequest struct {
 	UserID   string `json:"user_id" binding:"required"`
 	UpStream string `json:"upstream" binding:"required"`
 	Country  string `json:"country" binding:"required"`
 	IsSticky bool   `json:"issticky"`
+	// Rotation is sticky, per_request or interval. Empty means sticky
+	// when IsSticky is set and per_request otherwise.
+	Rotation string `json:"rotation,omitempty"`
+	// Lifetime of a sticky session in minutes, up to 1440. Zero uses the
+	// provider's default.
+	Lifetime int `json:"lifetime,omitempty"`
+	// RotateEvery is the interval in minutes for interval rotation.
+	RotateEvery int `json:"rotate_every,omitempty"`
+}
+
+// UserSession is a sticky session of a user across all workers that hold
+// it.
+type UserSession struct {
+	Session     string    `json:"session"`
+	Upstream    string    `json:"upstream"`
+	Country     string    `json:"country,omitempty"`
+	CreatedAt   time.Time `json:"created_at"`
+	ExpiresAt   time.Time `json:"expires_at"`
+	Bytes       int64     `json:"bytes"`
+	Connections int       `json:"connections"`
+	Workers     []string  `json:"workers"`
 }
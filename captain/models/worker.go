@@ -0,0 +1,112 @@
+package models
+
+import "time"
+
+const (
+	WorkerOnline  = "online"
+	WorkerOffline = "offline"
+	WorkerUnknown = "unknown"
+)
+
+type Worker struct {
+	Name          string         `json:"name"`
+	SubDomains    []string       `json:"subdomains"`
+	ConfigVersion int64          `json:"config_version"`
+	Version       string         `json:"version,omitempty"`
+	PublicAddr    string         `json:"public_addr,omitempty"`
+	Ports         map[string]int `json:"ports,omitempty"`
+	Status        string         `json:"status"` // online, offline, unknown
+	RegisteredAt  time.Time      `json:"registered_at,omitzero"`
+	LastSeen      time.Time      `json:"last_seen,omitzero"`
+	Stats         WorkerStats    `json:"stats"`
+	// Upstreams is the health of the outs the worker routes through, as
+	// of its last heartbeat.
+	Upstreams []UpstreamHealth `json:"upstreams,omitempty"`
+	// Token is the secret the worker sends with every request to captain.
+	// It is only shown once, when the worker is created.
+	Token string `json:"-"`
+}
+
+type WorkerStats struct {
+	ActiveConnections int64   `json:"active_connections"`
+	BytesInPerSec     float64 `json:"bytes_in_per_sec"`
+	BytesOutPerSec    float64 `json:"bytes_out_per_sec"`
+	StickySessions    int64   `json:"sticky_sessions"`
+}
+
+type CreateWorkerRequest struct {
+	Name       string   `json:"name" binding:"required"`
+	SubDomains []string `json:"subdomains"`
+	Token      string   `json:"token"` // generated when empty
+}
+
+// CreateWorkerResponse is the created worker along with its token.
+type CreateWorkerResponse struct {
+	*Worker
+	Token string `json:"token"`
+}
+
+type UpdateWorkerRequest struct {
+	SubDomains *[]string `json:"subdomains,omitempty"`
+	Token      *string   `json:"token,omitempty"`
+}
+
+type RegisterRequest struct {
+	Name       string         `json:"name" binding:"required"`
+	Version    string         `json:"version"`
+	PublicAddr string         `json:"public_addr"`
+	Ports      map[string]int `json:"ports"`
+}
+
+type HeartbeatRequest struct {
+	Name      string           `json:"name" binding:"required"`
+	Stats     WorkerStats      `json:"stats"`
+	Upstreams []UpstreamHealth `json:"upstreams,omitempty"`
+	Sessions  []ActiveSession  `json:"sessions,omitempty"`
+}
+
+// HeartbeatResponse hands workers the sessions killed recently, so those
+// that missed a kill_session event, or restarted since, catch up.
+type HeartbeatResponse struct {
+	Message        string          `json:"message"`
+	KilledSessions []KilledSession `json:"killed_sessions,omitempty"`
+}
+
+// KilledSession is how often captain has killed a user's session. Workers
+// give each generation of a session its own upstream session ID.
+type KilledSession struct {
+	UserID     string    `json:"user_id"`
+	Session    string    `json:"session"`
+	Generation int       `json:"generation"`
+	ExpiresAt  time.Time `json:"expires_at"`
+}
+
+// ActiveSession is a sticky session as one worker sees it.
+type ActiveSession struct {
+	UserID      string    `json:"user_id"`
+	Session     string    `json:"session"`
+	Upstream    string    `json:"upstream"`
+	Country     string    `json:"country,omitempty"`
+	CreatedAt   time.Time `json:"created_at"`
+	ExpiresAt   time.Time `json:"expires_at"`
+	Bytes       int64     `json:"bytes"`
+	Connections int       `json:"connections"`
+}
+
+type UpstreamHealth struct {
+	Upstream  string    `json:"upstream"`
+	State     string    `json:"state"` // closed, open, half_open
+	Failures  int       `json:"failures"`
+	CheckedAt time.Time `json:"checked_at,omitzero"`
+	LastError string    `json:"last_error,omitempty"`
+}
+
+type WorkerStatus struct {
+	Name       string         `json:"name"`
+	Status     string         `json:"status"`
+	Version    string         `json:"version,omitempty"`
+	PublicAddr string         `json:"public_addr,omitempty"`
+	Ports      map[string]int `json:"ports,omitempty"`
+	LastSeen   time.Time      `json:"last_seen,omitzero"`
+	Stats      WorkerStats    `json:"stats"`
+}
@@ -1,7 +1,11 @@
 package storage
 
 import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
 	"fmt"
+	"slices"
 	"sync"
 	"time"
 
@@ -9,24 +13,201 @@ import (
 )
 
 type MemoryStorage struct {
-	users   map[string]*models.User
-	pools   map[string]*models.Pool
-	Workers map[string]*models.Worker
-	Region  map[string]*models.Region
-	Country map[string]*models.Country
-	mu      sync.RWMutex
+	users         map[string]*models.User
+	pools         map[string]*models.Pool
+	Workers       map[string]*models.Worker
+	Region        map[string]*models.Region
+	Country       map[string]*models.Country
+	configVersion int64
+	subscribers   map[chan models.ConfigEvent]string
+	sessions      map[string]issuedSession
+	reported      map[string][]models.ActiveSession // by worker
+	killed        map[string]*models.KilledSession  // by user and session
+	mu            sync.RWMutex
+	subMu         sync.Mutex
 }
 
 func NewMemoryStorage() *MemoryStorage {
 	return &MemoryStorage{
-		users:   make(map[string]*models.User),
-		pools:   make(map[string]*models.Pool),
-		Workers: make(map[string]*models.Worker),
-		Region:  make(map[string]*models.Region),
-		Country: make(map[string]*models.Country),
+		users:       make(map[string]*models.User),
+		pools:       make(map[string]*models.Pool),
+		Workers:     make(map[string]*models.Worker),
+		Region:      make(map[string]*models.Region),
+		Country:     make(map[string]*models.Country),
+		subscribers: make(map[chan models.ConfigEvent]string),
+		sessions:    make(map[string]issuedSession),
+		reported:    make(map[string][]models.ActiveSession),
+		killed:      make(map[string]*models.KilledSession),
+		// Start from the boot time so versions keep increasing across
+		// restarts and workers never mistake new config for old.
+		configVersion: time.Now().UnixNano(),
 	}
 }
 
+// killedFor is how long the generation of a killed session is kept, the
+// longest a client can keep using a session ID.
+const killedFor = 24 * time.Hour
+
+// issuedSession is a session ID generated for a user, reserved until
+// expires.
+type issuedSession struct {
+	userID  string
+	expires time.Time
+}
+
+// ReserveSession records that session was issued to userID for ttl. It
+// fails while session is still reserved, for that user or any other, so
+// no two credentials share an upstream session and with it an exit IP.
+func (s *MemoryStorage) ReserveSession(userID, session string, ttl time.Duration) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	if issued, ok := s.sessions[session]; ok && now.Before(issued.expires) {
+		return fmt.Errorf("session %s already issued", session)
+	}
+
+	s.sessions[session] = issuedSession{userID: userID, expires: now.Add(ttl)}
+	return nil
+}
+
+// PruneSessions forgets issued sessions whose reservation has expired
+// and killed sessions that can no longer be in use.
+func (s *MemoryStorage) PruneSessions() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	pruned := 0
+	for session, issued := range s.sessions {
+		if !now.Before(issued.expires) {
+			delete(s.sessions, session)
+			pruned++
+		}
+	}
+	for key, k := range s.killed {
+		if !now.Before(k.ExpiresAt) {
+			delete(s.killed, key)
+		}
+	}
+
+	return pruned
+}
+
+// UserSessions merges the sticky sessions of userID that workers reported
+// in their last heartbeat. A session used through several workers is
+// listed once, with the bytes and connections of all of them.
+func (s *MemoryStorage) UserSessions(userID string) ([]models.UserSession, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if _, ok := s.users[userID]; !ok {
+		return nil, fmt.Errorf("user not found")
+	}
+
+	now := time.Now()
+	byID := make(map[string]*models.UserSession)
+	for worker, active := range s.reported {
+		for _, a := range active {
+			if a.UserID != userID || !now.Before(a.ExpiresAt) {
+				continue
+			}
+
+			us, ok := byID[a.Session]
+			if !ok {
+				us = &models.UserSession{
+					Session:   a.Session,
+					Upstream:  a.Upstream,
+					Country:   a.Country,
+					CreatedAt: a.CreatedAt,
+					ExpiresAt: a.ExpiresAt,
+				}
+				byID[a.Session] = us
+			}
+			if a.CreatedAt.Before(us.CreatedAt) {
+				us.CreatedAt = a.CreatedAt
+				us.Upstream = a.Upstream
+			}
+			if a.ExpiresAt.After(us.ExpiresAt) {
+				us.ExpiresAt = a.ExpiresAt
+			}
+			us.Bytes += a.Bytes
+			us.Connections += a.Connections
+			us.Workers = append(us.Workers, worker)
+		}
+	}
+
+	sessions := make([]models.UserSession, 0, len(byID))
+	for _, us := range byID {
+		slices.Sort(us.Workers)
+		sessions = append(sessions, *us)
+	}
+	slices.SortFunc(sessions, func(a, b models.UserSession) int {
+		return a.CreatedAt.Compare(b.CreatedAt)
+	})
+
+	return sessions, nil
+}
+
+// KillSession moves session of userID, which a worker must have reported
+// as live, to its next generation and tells every worker to drop it and
+// close its connections. Captain keeps the generation for killedFor, the
+// longest a session ID stays usable, and hands it out with heartbeat
+// replies, so workers that miss the event or restart still stop using
+// the old upstream session.
+func (s *MemoryStorage) KillSession(userID, session string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.users[userID]; !ok {
+		return fmt.Errorf("user not found")
+	}
+
+	now := time.Now()
+	found := false
+	for worker, active := range s.reported {
+		s.reported[worker] = slices.DeleteFunc(slices.Clone(active), func(a models.ActiveSession) bool {
+			if a.UserID != userID || a.Session != session {
+				return false
+			}
+			if now.Before(a.ExpiresAt) {
+				found = true
+			}
+			return true
+		})
+	}
+	if !found {
+		return fmt.Errorf("session not found")
+	}
+
+	key := userID + "\x00" + session
+	k, ok := s.killed[key]
+	if !ok {
+		k = &models.KilledSession{UserID: userID, Session: session}
+		s.killed[key] = k
+	}
+	k.Generation++
+	k.ExpiresAt = now.Add(killedFor)
+
+	s.publish(models.ConfigEvent{Type: models.EventKillSession, UserID: userID, Session: session, Generation: k.Generation})
+	return nil
+}
+
+// KilledSessions returns the sessions killed within killedFor.
+func (s *MemoryStorage) KilledSessions() []models.KilledSession {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	now := time.Now()
+	killed := make([]models.KilledSession, 0, len(s.killed))
+	for _, k := range s.killed {
+		if now.Before(k.ExpiresAt) {
+			killed = append(killed, *k)
+		}
+	}
+	return killed
+}
+
 func (s *MemoryStorage) CreateUser(user *models.User) error {
 	s.mu.Lock()
 	defer s.mu.Unlock()
@@ -41,6 +222,7 @@ func (s *MemoryStorage) CreateUser(user *models.User) error {
 	user.UpdatedAt = time.Now()
 	s.users[user.Id] = user
 	fmt.Printf("user created %v \n", s.users[user.Id].Id)
+	s.publish(models.ConfigEvent{Type: models.EventUser, UserID: user.Id})
 
 	return nil
 }
@@ -83,8 +265,8 @@ func (s *MemoryStorage) ListUsers() ([]*models.User, error) {
 }
 
 func (s *MemoryStorage) UpdateUser(id string, updateFun func(*models.User) error) error {
-	s.mu.RLock()
-	defer s.mu.RUnlock()
+	s.mu.Lock()
+	defer s.mu.Unlock()
 
 	user, ok := s.users[id]
 	if !ok {
@@ -96,6 +278,22 @@ func (s *MemoryStorage) UpdateUser(id string, updateFun func(*models.User) error
 	}
 
 	user.UpdatedAt = time.Now()
+	s.publish(models.ConfigEvent{Type: models.EventUser, UserID: id})
+	return nil
+}
+
+// AddDataUsed records traffic without notifying workers, usage reports
+// are not policy changes.
+func (s *MemoryStorage) AddDataUsed(id string, bytes int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	user, ok := s.users[id]
+	if !ok {
+		return fmt.Errorf("user not found")
+	}
+
+	user.DataUsed += bytes
 	return nil
 }
 
@@ -109,6 +307,7 @@ func (s *MemoryStorage) DeleteUser(id string) error {
 	}
 
 	delete(s.users, id)
+	s.publish(models.ConfigEvent{Type: models.EventUser, UserID: id})
 	return nil
 }
 
@@ -127,6 +326,7 @@ func (s *MemoryStorage) CreatePool(pool *models.Pool) error {
 
 	s.pools[pool.Name] = pool
 	fmt.Printf("pool created %v \n", s.pools[pool.Name].Name)
+	s.bumpConfigVersion(pool.Subdomain)
 	return nil
 }
 
@@ -163,10 +363,12 @@ func (s *MemoryStorage) UpdatePool(name string, updateFunc func(model *models.Po
 		return fmt.Errorf("pool not found")
 	}
 
+	oldSubdomain := pool.Subdomain
 	if err := updateFunc(pool); err != nil {
-		return fmt.Errorf("error in user request")
+		return fmt.Errorf("error in user request: %w", err)
 	}
 
+	s.bumpConfigVersion(oldSubdomain, pool.Subdomain)
 	return nil
 }
 
@@ -174,11 +376,13 @@ func (s *MemoryStorage) DeletePool(name string) error {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
-	if _, ok := s.pools[name]; !ok {
+	pool, ok := s.pools[name]
+	if !ok {
 		return fmt.Errorf("pool not found")
 	}
 
 	delete(s.pools, name)
+	s.bumpConfigVersion(pool.Subdomain)
 	return nil
 }
 
@@ -194,6 +398,94 @@ func (s *MemoryStorage) GetAllPools() (map[string]*models.Pool, error) {
 	return result, nil
 }
 
+// GetWorkerConfig returns the pools assigned to a worker through its
+// subdomains together with the worker's config version.
+func (s *MemoryStorage) GetWorkerConfig(name string) (map[string]*models.Pool, int64, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	worker, ok := s.Workers[name]
+	if !ok {
+		return nil, 0, fmt.Errorf("worker not found")
+	}
+
+	result := make(map[string]*models.Pool)
+	for k, v := range s.pools {
+		if slices.Contains(worker.SubDomains, v.Subdomain) {
+			result[k] = v
+		}
+	}
+
+	return result, worker.ConfigVersion, nil
+}
+
+func (s *MemoryStorage) WorkerConfigVersion(name string) (int64, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	worker, ok := s.Workers[name]
+	if !ok {
+		return 0, fmt.Errorf("worker not found")
+	}
+
+	return worker.ConfigVersion, nil
+}
+
+// Subscribe registers a listener for the config events of one worker. The
+// returned func must be called to release it.
+func (s *MemoryStorage) Subscribe(worker string) (<-chan models.ConfigEvent, func()) {
+	ch := make(chan models.ConfigEvent, 16)
+
+	s.subMu.Lock()
+	s.subscribers[ch] = worker
+	s.subMu.Unlock()
+
+	return ch, func() {
+		s.subMu.Lock()
+		delete(s.subscribers, ch)
+		s.subMu.Unlock()
+	}
+}
+
+// bumpConfigVersion moves every worker serving one of subdomains to a new
+// config version and notifies it. Must be called with mu held for writing.
+func (s *MemoryStorage) bumpConfigVersion(subdomains ...string) {
+	for _, worker := range s.Workers {
+		for _, subdomain := range subdomains {
+			if slices.Contains(worker.SubDomains, subdomain) {
+				s.bumpWorkerVersion(worker)
+				break
+			}
+		}
+	}
+}
+
+// bumpWorkerVersion must be called with mu held for writing.
+func (s *MemoryStorage) bumpWorkerVersion(worker *models.Worker) {
+	s.configVersion++
+	worker.ConfigVersion = s.configVersion
+	s.publish(models.ConfigEvent{Type: models.EventPools, Version: worker.ConfigVersion}, worker.Name)
+}
+
+// publish sends event to the subscribers of the given workers, or to all
+// of them when none are given. It never blocks, a subscriber that falls
+// behind misses the event and catches up from the version carried by the
+// next ping.
+func (s *MemoryStorage) publish(event models.ConfigEvent, workers ...string) {
+	s.subMu.Lock()
+	defer s.subMu.Unlock()
+
+	for ch, worker := range s.subscribers {
+		if len(workers) > 0 && !slices.Contains(workers, worker) {
+			continue
+		}
+		select {
+		case ch <- event:
+		default:
+		}
+	}
+}
+
 func (s *MemoryStorage) CreateWorker(worker *models.Worker) error {
 	s.mu.Lock()
 	defer s.mu.Unlock()
@@ -202,12 +494,182 @@ func (s *MemoryStorage) CreateWorker(worker *models.Worker) error {
 		return fmt.Errorf("worker with %s already Exit", worker.Name)
 	}
 
+	if worker.Status == "" {
+		worker.Status = models.WorkerUnknown
+	}
+	if worker.Token == "" {
+		worker.Token = newWorkerToken()
+	}
 	s.Workers[worker.Name] = worker
+	s.bumpWorkerVersion(worker)
 	fmt.Printf("worker created %v \n", s.Workers[worker.Name])
 
 	return nil
 }
 
+// RegisterWorker records a worker coming up. Workers have to be created
+// first, that is where they get their token.
+func (s *MemoryStorage) RegisterWorker(req *models.RegisterRequest) (*models.Worker, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	worker, ok := s.Workers[req.Name]
+	if !ok {
+		return nil, fmt.Errorf("worker not found")
+	}
+
+	now := time.Now()
+	worker.Version = req.Version
+	worker.PublicAddr = req.PublicAddr
+	worker.Ports = req.Ports
+	worker.Status = models.WorkerOnline
+	worker.RegisteredAt = now
+	worker.LastSeen = now
+	worker.Stats = models.WorkerStats{}
+
+	return worker, nil
+}
+
+// AuthenticateWorker checks token against the one captain issued to the
+// worker called name.
+func (s *MemoryStorage) AuthenticateWorker(name, token string) error {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	worker, ok := s.Workers[name]
+	if !ok {
+		return fmt.Errorf("worker not found")
+	}
+	if token == "" || subtle.ConstantTimeCompare([]byte(token), []byte(worker.Token)) != 1 {
+		return fmt.Errorf("invalid worker token")
+	}
+
+	return nil
+}
+
+func newWorkerToken() string {
+	b := make([]byte, 24)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+func (s *MemoryStorage) RecordHeartbeat(req *models.HeartbeatRequest) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	worker, ok := s.Workers[req.Name]
+	if !ok || worker.RegisteredAt.IsZero() {
+		return fmt.Errorf("worker not registered")
+	}
+
+	worker.Status = models.WorkerOnline
+	worker.LastSeen = time.Now()
+	worker.Stats = req.Stats
+	worker.Upstreams = req.Upstreams
+	s.reported[req.Name] = req.Sessions
+	return nil
+}
+
+// MarkOfflineWorkers flags online workers that have not been seen within
+// timeout and returns their names.
+func (s *MemoryStorage) MarkOfflineWorkers(timeout time.Duration) []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var offline []string
+	for name, worker := range s.Workers {
+		if worker.Status == models.WorkerOnline && time.Since(worker.LastSeen) > timeout {
+			worker.Status = models.WorkerOffline
+			worker.Stats = models.WorkerStats{}
+			worker.Upstreams = nil
+			delete(s.reported, name)
+			offline = append(offline, name)
+		}
+	}
+
+	return offline
+}
+
+func (s *MemoryStorage) WorkerStatuses() []models.WorkerStatus {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	statuses := make([]models.WorkerStatus, 0, len(s.Workers))
+	for _, worker := range s.Workers {
+		statuses = append(statuses, models.WorkerStatus{
+			Name:       worker.Name,
+			Status:     worker.Status,
+			Version:    worker.Version,
+			PublicAddr: worker.PublicAddr,
+			Ports:      worker.Ports,
+			LastSeen:   worker.LastSeen,
+			Stats:      worker.Stats,
+		})
+	}
+
+	return statuses
+}
+
+func (s *MemoryStorage) GetWorker(name string) (*models.Worker, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	worker, ok := s.Workers[name]
+	if !ok {
+		return nil, fmt.Errorf("worker not found")
+	}
+
+	return worker, nil
+}
+
+func (s *MemoryStorage) ListWorkers() ([]*models.Worker, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	workers := make([]*models.Worker, 0, len(s.Workers))
+	for _, worker := range s.Workers {
+		workers = append(workers, worker)
+	}
+
+	return workers, nil
+}
+
+// UpdateWorker applies updateFunc and, when the worker's subdomains
+// changed, pushes the new pool set to it.
+func (s *MemoryStorage) UpdateWorker(name string, updateFunc func(worker *models.Worker) error) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	worker, ok := s.Workers[name]
+	if !ok {
+		return fmt.Errorf("worker not found")
+	}
+
+	oldSubDomains := slices.Clone(worker.SubDomains)
+	if err := updateFunc(worker); err != nil {
+		return err
+	}
+
+	if !slices.Equal(oldSubDomains, worker.SubDomains) {
+		s.bumpWorkerVersion(worker)
+	}
+
+	return nil
+}
+
+func (s *MemoryStorage) DeleteWorker(name string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.Workers[name]; !ok {
+		return fmt.Errorf("worker not found")
+	}
+
+	delete(s.Workers, name)
+	delete(s.reported, name)
+	return nil
+}
+
 func (s *MemoryStorage) CreateRegion(region *models.Region) error {
 	s.mu.Lock()
 	defer s.mu.Unlock()
@@ -1,51 +1,98 @@
 package utils
 
 import (
-	"math"
-	"math/rand/v2"
-	"strconv"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/pubudu2003060/go-proxy-prototype/captain/models"
+	"github.com/pubudu2003060/go-proxy-prototype/filters"
+	"github.com/pubudu2003060/go-proxy-prototype/provider"
 )
 
-func GetFilters(upstream string, country string, isSticky bool) string {
+// maxSessionAttempts bounds the retries when a generated session ID is
+// already in use. With the default alphabet and length a single collision
+// is already unlikely.
+const maxSessionAttempts = 5
+
+// GetFilters returns the filters to append to a user's password for a
+// pool of the named provider. rotation is one of the models.Rotation*
+// modes; lifetime applies to sticky sessions and rotateEvery to interval
+// rotation. Session IDs are reserved for userID with reserve, which fails
+// for IDs still in use.
+func GetFilters(providerName string, country string, rotation string, lifetime, rotateEvery time.Duration, userID string, reserve func(userID, session string, ttl time.Duration) error) (string, error) {
 
 	//iproyal - username123:password321-country-dk_session-sgn34f3e_lifetime-1h@geo.iproyal.com:12321
 	//netnut - USERNAME:PASSWORD-res-nl-sid-94704546@gw.netnut.net:5959
 
-	var filter string
+	p := provider.Lookup(providerName)
+
+	f := filters.Filters{Country: strings.ToLower(country)}
+
+	if lifetime != 0 && rotation != models.RotationSticky {
+		return "", fmt.Errorf("lifetime needs %s rotation", models.RotationSticky)
+	}
+	if rotateEvery != 0 && rotation != models.RotationInterval {
+		return "", fmt.Errorf("rotate_every needs %s rotation", models.RotationInterval)
+	}
 
-	switch upstream {
-	case "netnut":
-		filter = "-res-" + country
-		if isSticky {
-			filter += "-sid-" + strconv.Itoa(generateSessionNumber())
+	switch rotation {
+	case models.RotationPerRequest:
+	case models.RotationSticky:
+		f.Lifetime = lifetime
+		if f.Lifetime == 0 {
+			f.Lifetime = p.DefaultLifetime
 		}
-	case "iproyal":
-		filter = "-country-" + country
-		if isSticky {
-			filter += "_session-" + generateSessionNumberString() + "_lifetime-1h"
+	case models.RotationInterval:
+		if rotateEvery == 0 {
+			return "", fmt.Errorf("%s rotation needs rotate_every", models.RotationInterval)
 		}
+		f.Rotation = filters.RotateInterval
+		f.RotateEvery = rotateEvery
+	default:
+		return "", fmt.Errorf("unknown rotation %q", rotation)
 	}
 
-	return filter
-}
+	if rotation != models.RotationPerRequest {
+		// Check the rest first so no ID is reserved for credentials that
+		// are then rejected.
+		f.Session = "x"
+		if err := f.Validate(); err != nil {
+			return "", err
+		}
 
-func generateSessionNumber() int {
-	return rand.IntN(89999999) + 10000000
+		// Sessions without a lifetime, and interval sessions, can be used
+		// for as long as the credentials are; reserve them for the longest
+		// lifetime there is.
+		ttl := f.Lifetime
+		if ttl == 0 {
+			ttl = filters.MaxLifetime
+		}
+
+		session, err := newSession(p, userID, ttl, reserve)
+		if err != nil {
+			return "", err
+		}
+		f.Session = session
+	}
+
+	if err := f.Validate(); err != nil {
+		return "", err
+	}
+	return p.Encode(f), nil
 }
 
-func generateSessionNumberString() string {
-	stringLoopRound := rand.IntN(8) + 1
-	numberLoopRound := 8 - stringLoopRound
-	number := rand.IntN(int(math.Pow10(numberLoopRound)))
-	var str string
-	for stringLoopRound >= 1 {
-		num := rune(rand.IntN(122-97+1) + 97)
-		str += string(num)
-		stringLoopRound--
+func newSession(p *provider.Provider, userID string, ttl time.Duration, reserve func(userID, session string, ttl time.Duration) error) (string, error) {
+	var err error
+	for range maxSessionAttempts {
+		var session string
+		session, err = p.NewSession()
+		if err != nil {
+			return "", err
+		}
+		if err = reserve(userID, session, ttl); err == nil {
+			return session, nil
+		}
 	}
-	runes := []rune(str + strconv.Itoa(number))
-	rand.Shuffle(len(runes), func(i, j int) {
-		runes[i], runes[j] = runes[j], runes[i]
-	})
-	return string(runes)
+	return "", fmt.Errorf("no free session ID after %d attempts: %w", maxSessionAttempts, err)
 }
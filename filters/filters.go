@@ -0,0 +1,282 @@
+// Package filters parses the targeting options clients append to their
+// proxy password, such as "-country-jp_session-ab12cd34_lifetime-30m". The
+// provider package renders them in the syntax an upstream expects.
+//
+// Grammar:
+//
+//	filters = [sep] pair { sep pair }
+//	pair    = key sep value
+//	sep     = "-" | "_"
+//
+// Keys are case insensitive and may appear once each:
+//
+//	pool              pool to route through, from the user's allowed pools
+//	country, cc, res  two letter country code
+//	city              city name, letters and digits only
+//	session, sid, sessid
+//	                  sticky session ID, letters and digits only
+//	lifetime, sesstime
+//	                  session lifetime as a duration ("30m", "2h") or a
+//	                  number of minutes
+//	rotate            "sticky", "request", or an interval as for lifetime
+//	                  to keep the session on one exit for that long and
+//	                  then move it to the next
+package filters
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	MinLifetime = time.Minute
+	MaxLifetime = 24 * time.Hour
+
+	maxValueLen = 64
+)
+
+type Rotation string
+
+const (
+	// RotateSticky keeps the session on one exit for its lifetime.
+	RotateSticky Rotation = "sticky"
+	// RotatePerRequest gives every connection a fresh exit.
+	RotatePerRequest Rotation = "request"
+	// RotateInterval moves the session to a fresh exit every RotateEvery.
+	RotateInterval Rotation = "interval"
+)
+
+type Filters struct {
+	Pool     string
+	Country  string
+	City     string
+	Session  string
+	Lifetime time.Duration
+	Rotation Rotation
+	// RotateEvery is the interval of RotateInterval.
+	RotateEvery time.Duration
+}
+
+var aliases = map[string]string{
+	"pool":     "pool",
+	"country":  "country",
+	"cc":       "country",
+	"res":      "country",
+	"city":     "city",
+	"session":  "session",
+	"sid":      "session",
+	"sessid":   "session",
+	"lifetime": "lifetime",
+	"sesstime": "lifetime",
+	"rotate":   "rotate",
+}
+
+// Parse parses a filter suffix. An empty string gives empty Filters.
+func Parse(s string) (Filters, error) {
+	var f Filters
+
+	s = strings.TrimLeft(s, "-_")
+	if s == "" {
+		return f, nil
+	}
+
+	tokens := strings.FieldsFunc(s, isSep)
+	if len(tokens) != strings.Count(s, "-")+strings.Count(s, "_")+1 {
+		return Filters{}, fmt.Errorf("empty filter in %q", s)
+	}
+	if len(tokens)%2 != 0 {
+		return Filters{}, fmt.Errorf("filter %q has no value", tokens[len(tokens)-1])
+	}
+
+	seen := make(map[string]bool)
+	for i := 0; i < len(tokens); i += 2 {
+		key, ok := aliases[strings.ToLower(tokens[i])]
+		if !ok {
+			return Filters{}, fmt.Errorf("unknown filter %q", tokens[i])
+		}
+		if seen[key] {
+			return Filters{}, fmt.Errorf("duplicate filter %q", key)
+		}
+		seen[key] = true
+
+		if err := f.set(key, tokens[i+1]); err != nil {
+			return Filters{}, err
+		}
+	}
+
+	if err := f.Validate(); err != nil {
+		return Filters{}, err
+	}
+	return f, nil
+}
+
+func isSep(r rune) bool {
+	return r == '-' || r == '_'
+}
+
+func (f *Filters) set(key, value string) error {
+	switch key {
+	case "pool":
+		f.Pool = strings.ToLower(value)
+	case "country":
+		f.Country = strings.ToLower(value)
+	case "city":
+		f.City = strings.ToLower(value)
+	case "session":
+		f.Session = value
+	case "lifetime":
+		lifetime, err := parseLifetime(value)
+		if err != nil {
+			return err
+		}
+		f.Lifetime = lifetime
+	case "rotate":
+		switch rotation := Rotation(strings.ToLower(value)); rotation {
+		case RotateSticky, RotatePerRequest:
+			f.Rotation = rotation
+		default:
+			every, err := parseLifetime(value)
+			if err != nil {
+				return fmt.Errorf("invalid rotation %q: want sticky, request or an interval", value)
+			}
+			f.Rotation = RotateInterval
+			f.RotateEvery = every
+		}
+	}
+	return nil
+}
+
+// parseLifetime takes whole seconds only, so every lifetime it returns
+// formats back to itself. Range checks are left to Validate, except that
+// minute counts are capped first as they could overflow.
+func parseLifetime(value string) (time.Duration, error) {
+	if minutes, err := strconv.Atoi(value); err == nil {
+		if minutes > int(MaxLifetime/time.Minute) {
+			return 0, fmt.Errorf("lifetime %q out of range %v to %v", value, MinLifetime, MaxLifetime)
+		}
+		return time.Duration(minutes) * time.Minute, nil
+	}
+
+	lifetime, err := time.ParseDuration(value)
+	if err != nil || lifetime%time.Second != 0 {
+		return 0, fmt.Errorf("invalid lifetime %q", value)
+	}
+	return lifetime, nil
+}
+
+// Validate checks every set field.
+func (f Filters) Validate() error {
+	if f.Pool != "" && !isAlnum(f.Pool) {
+		return fmt.Errorf("invalid pool %q", f.Pool)
+	}
+	if f.Country != "" && (len(f.Country) != 2 || !isLetters(f.Country)) {
+		return fmt.Errorf("invalid country %q: want a two letter code", f.Country)
+	}
+	if f.City != "" && !isAlnum(f.City) {
+		return fmt.Errorf("invalid city %q", f.City)
+	}
+	if f.Session != "" && !isAlnum(f.Session) {
+		return fmt.Errorf("invalid session %q: want up to %d letters and digits", f.Session, maxValueLen)
+	}
+	if f.Lifetime != 0 && (f.Lifetime < MinLifetime || f.Lifetime > MaxLifetime) {
+		return fmt.Errorf("lifetime %v out of range %v to %v", f.Lifetime, MinLifetime, MaxLifetime)
+	}
+
+	switch f.Rotation {
+	case "", RotateSticky:
+	case RotatePerRequest:
+		if f.Session != "" {
+			return fmt.Errorf("rotate-%s cannot be combined with a session", f.Rotation)
+		}
+	case RotateInterval:
+		if f.Session == "" {
+			return fmt.Errorf("rotate-%s needs a session", FormatLifetime(f.RotateEvery))
+		}
+		if f.Lifetime != 0 {
+			return fmt.Errorf("lifetime cannot be combined with a rotation interval")
+		}
+		if f.RotateEvery < MinLifetime || f.RotateEvery > MaxLifetime {
+			return fmt.Errorf("rotation interval %v out of range %v to %v", f.RotateEvery, MinLifetime, MaxLifetime)
+		}
+	default:
+		return fmt.Errorf("invalid rotation %q", f.Rotation)
+	}
+
+	return nil
+}
+
+// Sticky reports whether connections should keep the same exit.
+func (f Filters) Sticky() bool {
+	return f.Session != "" && f.Rotation != RotatePerRequest
+}
+
+// Window returns the start of the period of length every that now falls
+// in. Periods are aligned to the Unix epoch, so every worker agrees on
+// them without sharing any state; a session's first period may be short.
+func Window(every time.Duration, now time.Time) time.Time {
+	return time.Unix(0, now.UnixNano()/int64(every)*int64(every))
+}
+
+// String returns the canonical form, "-key-value" pairs joined by '_' in
+// a fixed order. Parse(f.String()) returns f.
+func (f Filters) String() string {
+	var pairs []string
+	add := func(key, value string) {
+		if value != "" {
+			pairs = append(pairs, key+"-"+value)
+		}
+	}
+
+	add("pool", f.Pool)
+	add("country", f.Country)
+	add("city", f.City)
+	add("session", f.Session)
+	add("lifetime", FormatLifetime(f.Lifetime))
+	if f.Rotation == RotateInterval {
+		add("rotate", FormatLifetime(f.RotateEvery))
+	} else {
+		add("rotate", string(f.Rotation))
+	}
+
+	if len(pairs) == 0 {
+		return ""
+	}
+	return "-" + strings.Join(pairs, "_")
+}
+
+// FormatLifetime formats d in whole hours, minutes or seconds, the form
+// Parse accepts. Zero formats as "".
+func FormatLifetime(d time.Duration) string {
+	switch {
+	case d == 0:
+		return ""
+	case d%time.Hour == 0:
+		return strconv.Itoa(int(d/time.Hour)) + "h"
+	case d%time.Minute == 0:
+		return strconv.Itoa(int(d/time.Minute)) + "m"
+	}
+	return strconv.Itoa(int(d/time.Second)) + "s"
+}
+
+func isAlnum(s string) bool {
+	if len(s) > maxValueLen {
+		return false
+	}
+	for _, r := range s {
+		if !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9') {
+			return false
+		}
+	}
+	return true
+}
+
+func isLetters(s string) bool {
+	for _, r := range s {
+		if !(r >= 'a' && r <= 'z') {
+			return false
+		}
+	}
+	return true
+}
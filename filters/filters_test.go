@@ -0,0 +1,124 @@
+package filters
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		in   string
+		want Filters
+	}{
+		{"", Filters{}},
+		{"-", Filters{}},
+		{"-country-jp", Filters{Country: "jp"}},
+		{"_CC-US", Filters{Country: "us"}},
+		{"-country-jp_session-ab12cd34_lifetime-30m", Filters{Country: "jp", Session: "ab12cd34", Lifetime: 30 * time.Minute}},
+		{"-res-de-sid-x1-sesstime-90", Filters{Country: "de", Session: "x1", Lifetime: 90 * time.Minute}},
+		{"-pool-EU_city-Berlin", Filters{Pool: "eu", City: "berlin"}},
+		{"-session-abc_rotate-sticky", Filters{Session: "abc", Rotation: RotateSticky}},
+		{"-rotate-request", Filters{Rotation: RotatePerRequest}},
+		{"-session-abc_rotate-10m", Filters{Session: "abc", Rotation: RotateInterval, RotateEvery: 10 * time.Minute}},
+		{"-session-abc_rotate-2", Filters{Session: "abc", Rotation: RotateInterval, RotateEvery: 2 * time.Minute}},
+		{"-lifetime-1m", Filters{Lifetime: MinLifetime}},
+		{"-lifetime-24h", Filters{Lifetime: MaxLifetime}},
+	}
+
+	for _, tt := range tests {
+		got, err := Parse(tt.in)
+		if err != nil {
+			t.Errorf("Parse(%q): %v", tt.in, err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("Parse(%q) = %#v, want %#v", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		in   string
+	}{
+		{"empty pair", "-country-jp_"},
+		{"empty value", "-country--session-a"},
+		{"no value", "-country-jp_session"},
+		{"unknown key", "-colour-red"},
+		{"duplicate key", "-country-jp_country-us"},
+		{"duplicate alias", "-country-jp_cc-us"},
+		{"bad country", "-country-jpn"},
+		{"bad session", "-session-a.b"},
+		{"long session", "-session-" + strings.Repeat("a", maxValueLen+1)},
+		{"per request with session", "-rotate-request_session-abc"},
+		{"interval without session", "-rotate-10m"},
+		{"interval with lifetime", "-session-abc_rotate-10m_lifetime-30m"},
+		{"interval too short", "-session-abc_rotate-30s"},
+		{"bad rotation", "-session-abc_rotate-often"},
+		{"lifetime too short", "-lifetime-30s"},
+		{"lifetime too long", "-lifetime-25h"},
+		{"lifetime minutes too long", "-lifetime-1441"},
+		{"lifetime overflow", "-lifetime-307445736"},
+		{"bad lifetime", "-lifetime-soon"},
+	}
+
+	for _, tt := range tests {
+		if f, err := Parse(tt.in); err == nil {
+			t.Errorf("%s: Parse(%q) = %#v, want error", tt.name, tt.in, f)
+		}
+	}
+}
+
+func FuzzParse(f *testing.F) {
+	for _, seed := range []string{
+		"",
+		"-country-jp_session-ab12cd34_lifetime-30m",
+		"_cc-us-sid-x-sesstime-90",
+		"-pool-eu_city-berlin_rotate-sticky",
+		"-rotate-request",
+		"-session-abc_rotate-10m",
+		"-lifetime-1h30m",
+		"-lifetime-90500ms",
+		"-lifetime-307445736",
+		"-country-jp_",
+	} {
+		f.Add(seed)
+	}
+
+	f.Fuzz(func(t *testing.T, s string) {
+		parsed, err := Parse(s)
+		if err != nil {
+			return
+		}
+
+		again, err := Parse(parsed.String())
+		if err != nil {
+			t.Fatalf("Parse(%q) accepted %#v but its String %q fails: %v", s, parsed, parsed.String(), err)
+		}
+		if again != parsed {
+			t.Fatalf("Parse(%q) = %#v, but Parse(%q) = %#v", s, parsed, parsed.String(), again)
+		}
+	})
+}
+
+func TestWindow(t *testing.T) {
+	start := time.Date(2026, 1, 2, 10, 0, 0, 0, time.UTC)
+	tests := []struct {
+		now  time.Time
+		want time.Time
+	}{
+		{start, start},
+		{start.Add(-time.Second), start.Add(-10 * time.Minute)},
+		{start.Add(9*time.Minute + 59*time.Second), start},
+		{start.Add(10 * time.Minute), start.Add(10 * time.Minute)},
+		{start.Add(25 * time.Minute), start.Add(20 * time.Minute)},
+	}
+
+	for _, tt := range tests {
+		if got := Window(10*time.Minute, tt.now); !got.Equal(tt.want) {
+			t.Errorf("Window at %v = %v, want %v", tt.now.Sub(start), got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,265 @@
+// Package provider describes the upstream proxy providers pools can sit in
+// front of: how each encodes targeting filters into the upstream
+// credentials and which port it listens on by default. Pools refer to a
+// provider by name.
+//
+// A provider's Template is the only description of its syntax. It renders
+// the upstream credentials on the worker, and its optional groups give
+// the filters captain hands out to clients, so both use the same keys.
+package provider
+
+import (
+	"crypto/rand"
+	"crypto/sha512"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"math/big"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/pubudu2003060/go-proxy-prototype/filters"
+)
+
+type Provider struct {
+	Name        string
+	DefaultPort int
+	// Template renders the upstream credentials for outs that set a
+	// username and password but no format of their own. Filters without a
+	// placeholder in it are not supported by the provider.
+	Template string
+
+	// SessionAlphabet and SessionLength shape the session IDs NewSession
+	// generates, for providers that only accept some IDs. Empty and zero
+	// mean DefaultSessionAlphabet and DefaultSessionLength. DeriveSession
+	// keeps to the alphabet but may need longer IDs.
+	SessionAlphabet string
+	SessionLength   int
+	// DefaultLifetime is used for sticky sessions that do not ask for a
+	// lifetime, zero to leave it to the provider.
+	DefaultLifetime time.Duration
+}
+
+const (
+	DefaultSessionAlphabet = "abcdefghijklmnopqrstuvwxyz0123456789"
+	DefaultSessionLength   = 8
+)
+
+// derivedSessionBits is how much of the hash DeriveSession keeps, enough
+// that no two sessions are expected to share an ID however many there are.
+const derivedSessionBits = 128
+
+// Generic passes filters on in the canonical filters syntax. It is used
+// for pools without a provider.
+var Generic = &Provider{
+	Name:     "",
+	Template: "{user}:{pass}[-country-{country}][_city-{city}][_session-{session}][_lifetime-{lifetime}]",
+}
+
+var (
+	registry = make(map[string]*Provider)
+	mu       sync.RWMutex
+)
+
+func init() {
+	// USERNAME:PASSWORD-res-nl-sid-94704546@gw.netnut.net:5959
+	Register(&Provider{
+		Name:            "netnut",
+		DefaultPort:     5959,
+		Template:        "{user}:{pass}[-res-{country}][-sid-{session}]",
+		SessionAlphabet: "0123456789",
+	})
+	// username:password-country-dk_session-sgn34f3e_lifetime-1h@geo.iproyal.com:12321
+	Register(&Provider{
+		Name:            "iproyal",
+		DefaultPort:     12321,
+		Template:        "{user}:{pass}[-country-{country}][_city-{city}][_session-{session}][_lifetime-{lifetime}]",
+		DefaultLifetime: time.Hour,
+	})
+	// brd-customer-ID-zone-ZONE-country-us-city-newyork-session-abc:password@brd.superproxy.io:22225
+	Register(&Provider{
+		Name:        "brightdata",
+		DefaultPort: 22225,
+		Template:    "{user}[-country-{country}][-city-{city}][-session-{session}]:{pass}",
+	})
+	// customer-USER-cc-US-city-london-sessid-abc-sesstime-10:password@pr.oxylabs.io:7777
+	Register(&Provider{
+		Name:        "oxylabs",
+		DefaultPort: 7777,
+		Template:    "{user}[-cc-{country}][-city-{city}][-sessid-{session}][-sesstime-{lifetime_m}]:{pass}",
+	})
+}
+
+// Register adds p to the registry. Names are unique.
+func Register(p *Provider) error {
+	if p.Name == "" {
+		return errors.New("provider name is required")
+	}
+	if _, err := ParseTemplate(p.Template); err != nil {
+		return fmt.Errorf("provider %s: %w", p.Name, err)
+	}
+	if err := p.checkFilters(); err != nil {
+		return fmt.Errorf("provider %s: %w", p.Name, err)
+	}
+	if p.SessionLength < 0 || p.SessionLength > 64 {
+		return fmt.Errorf("provider %s: session length %d over 64", p.Name, p.SessionLength)
+	}
+	if p.SessionAlphabet != "" && len(p.SessionAlphabet) < 4 {
+		return fmt.Errorf("provider %s: session alphabet needs at least 4 characters", p.Name)
+	}
+	for _, r := range p.SessionAlphabet {
+		if !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9') {
+			return fmt.Errorf("provider %s: session alphabet must be letters and digits", p.Name)
+		}
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	if _, exists := registry[p.Name]; exists {
+		return fmt.Errorf("provider %s already registered", p.Name)
+	}
+	registry[p.Name] = p
+	return nil
+}
+
+func Get(name string) (*Provider, bool) {
+	mu.RLock()
+	defer mu.RUnlock()
+
+	p, ok := registry[name]
+	return p, ok
+}
+
+// Lookup returns the named provider, or Generic when there is none.
+func Lookup(name string) *Provider {
+	if p, ok := Get(name); ok {
+		return p
+	}
+	return Generic
+}
+
+func Names() []string {
+	mu.RLock()
+	defer mu.RUnlock()
+
+	names := make([]string, 0, len(registry))
+	for name := range registry {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Encode renders the filters the way clients append them to their
+// password, in the syntax of the provider's Template. Pool is handled by
+// the worker and never sent upstream. A lifetime the template has no
+// placeholder for, and interval rotation, use the worker's own keys so
+// the worker can enforce them.
+func (p *Provider) Encode(f filters.Filters) string {
+	tmpl, err := ParseTemplate(p.Template)
+	if err != nil {
+		return ""
+	}
+
+	encoded := tmpl.Filters(f)
+	if f.Lifetime > 0 && !tmpl.Uses("lifetime") && !tmpl.Uses("lifetime_m") {
+		encoded += "_lifetime-" + filters.FormatLifetime(f.Lifetime)
+	}
+	if f.Rotation == filters.RotateInterval {
+		encoded += "_rotate-" + filters.FormatLifetime(f.RotateEvery)
+	}
+	return encoded
+}
+
+// checkFilters makes sure the worker parses what Encode hands out, so a
+// template cannot use keys the filters package does not know.
+func (p *Provider) checkFilters() error {
+	tmpl, err := ParseTemplate(p.Template)
+	if err != nil {
+		return err
+	}
+
+	want := filters.Filters{Country: "us", City: "newyork", Session: "abc123", Lifetime: time.Hour}
+	if !tmpl.Uses("country") {
+		want.Country = ""
+	}
+	if !tmpl.Uses("city") {
+		want.City = ""
+	}
+	if !tmpl.Uses("session") {
+		want.Session = ""
+	}
+
+	encoded := p.Encode(want)
+	got, err := filters.Parse(encoded)
+	if err != nil {
+		return fmt.Errorf("template filters %q do not parse: %w", encoded, err)
+	}
+	if got != want {
+		return fmt.Errorf("template filters %q parse as %q", encoded, got.String())
+	}
+	return nil
+}
+
+func (p *Provider) sessionShape() (string, int) {
+	alphabet := p.SessionAlphabet
+	if alphabet == "" {
+		alphabet = DefaultSessionAlphabet
+	}
+	length := p.SessionLength
+	if length == 0 {
+		length = DefaultSessionLength
+	}
+	return alphabet, length
+}
+
+// NewSession returns a random session ID in the provider's alphabet,
+// drawn from crypto/rand.
+func (p *Provider) NewSession() (string, error) {
+	alphabet, length := p.sessionShape()
+
+	max := big.NewInt(int64(len(alphabet)))
+	id := make([]byte, length)
+	for i := range id {
+		n, err := rand.Int(rand.Reader, max)
+		if err != nil {
+			return "", err
+		}
+		id[i] = alphabet[n.Int64()]
+	}
+	return string(id), nil
+}
+
+// DeriveSession returns a session ID in the provider's alphabet that is a
+// hash of parts, so the same parts always give the same ID and different
+// parts practically never do. It carries derivedSessionBits of the hash,
+// which makes it longer than SessionLength for small alphabets, and skips
+// hash bytes that would favour some characters over others.
+func (p *Provider) DeriveSession(parts ...string) string {
+	alphabet, length := p.sessionShape()
+	if n := int(math.Ceil(derivedSessionBits / math.Log2(float64(len(alphabet))))); n > length {
+		length = n
+	}
+
+	h := sha512.New()
+	for _, part := range parts {
+		h.Write([]byte(part))
+		h.Write([]byte{0})
+	}
+	seed := h.Sum(nil)
+
+	limit := 256 - 256%len(alphabet)
+	id := make([]byte, 0, length)
+	for block := uint64(0); len(id) < length; block++ {
+		sum := sha512.Sum512(binary.BigEndian.AppendUint64(seed, block))
+		for _, b := range sum {
+			if int(b) < limit && len(id) < length {
+				id = append(id, alphabet[int(b)%len(alphabet)])
+			}
+		}
+	}
+	return string(id)
+}
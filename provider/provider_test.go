@@ -0,0 +1,67 @@
+package provider
+
+import (
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestDeriveSession(t *testing.T) {
+	netnut, _ := Get("netnut")
+	iproyal, _ := Get("iproyal")
+
+	id := iproyal.DeriveSession("user1", "abc", "0")
+	if id != iproyal.DeriveSession("user1", "abc", "0") {
+		t.Error("DeriveSession is not stable")
+	}
+	if len(id) != 25 || strings.Trim(id, DefaultSessionAlphabet) != "" {
+		t.Errorf("DeriveSession = %q, want 25 characters of %q", id, DefaultSessionAlphabet)
+	}
+
+	for _, parts := range [][]string{
+		{"user2", "abc", "0"},
+		{"user1", "abc", "1"},
+		{"user1a", "bc", "0"},
+		{"user1", "abc", "0", "1767348030"},
+	} {
+		if other := iproyal.DeriveSession(parts...); other == id {
+			t.Errorf("DeriveSession(%q) = DeriveSession(user1, abc, 0)", parts)
+		}
+	}
+
+	if id := netnut.DeriveSession("user1", "abc", "0"); len(id) != 39 || strings.Trim(id, "0123456789") != "" {
+		t.Errorf("netnut DeriveSession = %q, want 39 digits", id)
+	}
+}
+
+func TestDeriveSessionUniform(t *testing.T) {
+	netnut, _ := Get("netnut")
+
+	// A biased mapping of hash bytes gives 0 to 5 about 4% more often
+	// than 6 to 9; each digit should get a tenth of the characters.
+	const ids = 20000
+	counts := make(map[rune]int)
+	total := 0
+	for i := range ids {
+		for _, r := range netnut.DeriveSession("user", strconv.Itoa(i), "0") {
+			counts[r]++
+			total++
+		}
+	}
+	for r, n := range counts {
+		if share := float64(n) / float64(total); share < 0.098 || share > 0.102 {
+			t.Errorf("digit %c makes up %.4f of IDs, want 0.1", r, share)
+		}
+	}
+}
+
+func TestRegisterRejectsShortAlphabet(t *testing.T) {
+	err := Register(&Provider{
+		Name:            "test-short-alphabet",
+		Template:        "{user}:{pass}[-session-{session}]",
+		SessionAlphabet: "01",
+	})
+	if err == nil {
+		t.Error("Register accepted a session alphabet too short for derived IDs")
+	}
+}
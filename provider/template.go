@@ -0,0 +1,230 @@
+package provider
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pubudu2003060/go-proxy-prototype/filters"
+)
+
+// Template is a parsed Out.Format. It renders the upstream
+// "username:password" for a request. Placeholders in braces are replaced
+// and text in square brackets is only kept when every placeholder inside
+// has a value:
+//
+//	{user}:{pass}[-res-{country}][-sid-{session}]
+//
+// Placeholders are {user}, {pass}, {country}, {city}, {session},
+// {lifetime} ("30m", "1h") and {lifetime_m} (minutes). Exactly one ':'
+// outside the brackets separates the username from the password.
+//
+// The optional groups are also the provider's filter syntax, so Filters
+// can offer clients the same keys the upstream uses.
+type Template struct {
+	raw      string
+	segments []segment
+}
+
+type segment struct {
+	optional bool
+	items    []item
+}
+
+type item struct {
+	literal     string
+	placeholder string
+}
+
+var placeholders = map[string]bool{
+	"user":       true,
+	"pass":       true,
+	"country":    true,
+	"city":       true,
+	"session":    true,
+	"lifetime":   true,
+	"lifetime_m": true,
+}
+
+// IsTemplate reports whether format uses the template syntax rather than
+// the older "user:pass-%s" form.
+func IsTemplate(format string) bool {
+	return strings.ContainsAny(format, "{[")
+}
+
+func ParseTemplate(s string) (*Template, error) {
+	t := &Template{raw: s}
+	cur := segment{}
+
+	flush := func() {
+		if len(cur.items) > 0 {
+			t.segments = append(t.segments, cur)
+		}
+		cur = segment{}
+	}
+
+	for i := 0; i < len(s); {
+		switch s[i] {
+		case '{':
+			end := strings.IndexByte(s[i:], '}')
+			if end < 0 {
+				return nil, fmt.Errorf("unclosed placeholder at %d", i)
+			}
+			name := s[i+1 : i+end]
+			if !placeholders[name] {
+				return nil, fmt.Errorf("unknown placeholder {%s}", name)
+			}
+			cur.items = append(cur.items, item{placeholder: name})
+			i += end + 1
+		case '}':
+			return nil, fmt.Errorf("unexpected '}' at %d", i)
+		case '[':
+			if cur.optional {
+				return nil, fmt.Errorf("nested optional group at %d", i)
+			}
+			flush()
+			cur.optional = true
+			i++
+		case ']':
+			if !cur.optional {
+				return nil, fmt.Errorf("unexpected ']' at %d", i)
+			}
+			if !cur.hasPlaceholder() {
+				return nil, fmt.Errorf("optional group ending at %d has no placeholder", i)
+			}
+			flush()
+			i++
+		default:
+			end := strings.IndexAny(s[i:], "{}[]")
+			if end < 0 {
+				end = len(s) - i
+			}
+			cur.items = append(cur.items, item{literal: s[i : i+end]})
+			i += end
+		}
+	}
+	if cur.optional {
+		return nil, fmt.Errorf("unclosed optional group in %q", s)
+	}
+	flush()
+
+	colons := 0
+	for _, seg := range t.segments {
+		for _, it := range seg.items {
+			n := strings.Count(it.literal, ":")
+			if n > 0 && seg.optional {
+				return nil, fmt.Errorf("':' inside an optional group in %q", s)
+			}
+			colons += n
+		}
+	}
+	if colons != 1 {
+		return nil, fmt.Errorf("template %q must separate username and password with one ':'", s)
+	}
+
+	return t, nil
+}
+
+func (s segment) hasPlaceholder() bool {
+	for _, it := range s.items {
+		if it.placeholder != "" {
+			return true
+		}
+	}
+	return false
+}
+
+// Uses reports whether the template has the placeholder name.
+func (t *Template) Uses(name string) bool {
+	for _, seg := range t.segments {
+		for _, it := range seg.items {
+			if it.placeholder == name {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (t *Template) String() string {
+	return t.raw
+}
+
+func values(user, pass string, f filters.Filters) map[string]string {
+	values := map[string]string{
+		"user":     user,
+		"pass":     pass,
+		"country":  f.Country,
+		"city":     f.City,
+		"session":  f.Session,
+		"lifetime": filters.FormatLifetime(f.Lifetime),
+	}
+	if f.Lifetime > 0 {
+		values["lifetime_m"] = strconv.Itoa(int(f.Lifetime / time.Minute))
+	}
+	return values
+}
+
+// Render fills the template for the upstream account user and pass and
+// the request's filters, and returns the upstream username and password.
+func (t *Template) Render(user, pass string, f filters.Filters) (string, string, error) {
+	values := values(user, pass, f)
+
+	var b strings.Builder
+	split := -1
+
+	for _, seg := range t.segments {
+		if seg.optional && !seg.complete(values) {
+			continue
+		}
+		for _, it := range seg.items {
+			if it.placeholder == "" {
+				if i := strings.IndexByte(it.literal, ':'); i >= 0 {
+					split = b.Len() + i
+				}
+				b.WriteString(it.literal)
+				continue
+			}
+
+			value := values[it.placeholder]
+			if value == "" {
+				return "", "", fmt.Errorf("template %q needs {%s}", t.raw, it.placeholder)
+			}
+			b.WriteString(value)
+		}
+	}
+
+	rendered := b.String()
+	return rendered[:split], rendered[split+1:], nil
+}
+
+// Filters renders only the optional groups that f fills, which is f in
+// the provider's syntax without the account credentials.
+func (t *Template) Filters(f filters.Filters) string {
+	values := values("", "", f)
+
+	var b strings.Builder
+	for _, seg := range t.segments {
+		if !seg.optional || !seg.complete(values) {
+			continue
+		}
+		for _, it := range seg.items {
+			if it.placeholder == "" {
+				b.WriteString(it.literal)
+			} else {
+				b.WriteString(values[it.placeholder])
+			}
+		}
+	}
+	return b.String()
+}
+
+func (s segment) complete(values map[string]string) bool {
+	for _, it := range s.items {
+		if it.placeholder != "" && values[it.placeholder] == "" {
+			return false
+		}
+	}
+	return true
+}
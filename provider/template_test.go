@@ -0,0 +1,146 @@
+package provider
+
+import (
+	"testing"
+	"time"
+
+	"github.com/pubudu2003060/go-proxy-prototype/filters"
+)
+
+func TestRender(t *testing.T) {
+	accounts := map[string]string{
+		"netnut":     "acct",
+		"iproyal":    "acct",
+		"brightdata": "brd-customer-1",
+		"oxylabs":    "customer-1",
+	}
+
+	tests := []struct {
+		provider string
+		f        filters.Filters
+		user     string
+		pass     string
+	}{
+		{"netnut", filters.Filters{}, "acct", "secret"},
+		{"netnut", filters.Filters{Country: "nl"}, "acct", "secret-res-nl"},
+		{"netnut", filters.Filters{Session: "94704546"}, "acct", "secret-sid-94704546"},
+		{"netnut", filters.Filters{Country: "nl", Session: "94704546", Lifetime: time.Hour}, "acct", "secret-res-nl-sid-94704546"},
+
+		{"iproyal", filters.Filters{}, "acct", "secret"},
+		{"iproyal", filters.Filters{Country: "dk"}, "acct", "secret-country-dk"},
+		{"iproyal", filters.Filters{Session: "sgn34f3e", Lifetime: time.Hour}, "acct", "secret_session-sgn34f3e_lifetime-1h"},
+		{"iproyal", filters.Filters{Country: "dk", City: "aarhus", Session: "sgn34f3e", Lifetime: 90 * time.Minute}, "acct", "secret-country-dk_city-aarhus_session-sgn34f3e_lifetime-90m"},
+
+		{"brightdata", filters.Filters{}, "brd-customer-1", "secret"},
+		{"brightdata", filters.Filters{Country: "us"}, "brd-customer-1-country-us", "secret"},
+		{"brightdata", filters.Filters{Session: "abc", Lifetime: time.Hour}, "brd-customer-1-session-abc", "secret"},
+		{"brightdata", filters.Filters{Country: "us", City: "newyork", Session: "abc"}, "brd-customer-1-country-us-city-newyork-session-abc", "secret"},
+
+		{"oxylabs", filters.Filters{}, "customer-1", "secret"},
+		{"oxylabs", filters.Filters{Country: "gb"}, "customer-1-cc-gb", "secret"},
+		{"oxylabs", filters.Filters{Session: "abc", Lifetime: 10 * time.Minute}, "customer-1-sessid-abc-sesstime-10", "secret"},
+		{"oxylabs", filters.Filters{Country: "gb", City: "london", Session: "abc", Lifetime: 2 * time.Hour}, "customer-1-cc-gb-city-london-sessid-abc-sesstime-120", "secret"},
+	}
+
+	for _, tt := range tests {
+		p, ok := Get(tt.provider)
+		if !ok {
+			t.Fatalf("provider %s not registered", tt.provider)
+		}
+		tmpl, err := ParseTemplate(p.Template)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.provider, err)
+		}
+
+		user, pass, err := tmpl.Render(accounts[tt.provider], "secret", tt.f)
+		if err != nil {
+			t.Errorf("%s %q: %v", tt.provider, tt.f.String(), err)
+			continue
+		}
+		if user != tt.user || pass != tt.pass {
+			t.Errorf("%s %q = %s:%s, want %s:%s", tt.provider, tt.f.String(), user, pass, tt.user, tt.pass)
+		}
+	}
+}
+
+func TestRenderMissingRequired(t *testing.T) {
+	tmpl, err := ParseTemplate("{user}-sid-{session}:{pass}")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := tmpl.Render("acct", "secret", filters.Filters{}); err == nil {
+		t.Error("Render without a session succeeded, want error")
+	}
+}
+
+func TestParseTemplateErrors(t *testing.T) {
+	tests := []struct {
+		name   string
+		format string
+	}{
+		{"nested group", "{user}:{pass}[-a[-b-{country}]]"},
+		{"colon in group", "{user}[:{country}]{pass}"},
+		{"colon in group after pass", "{user}:{pass}[-x:{country}]"},
+		{"unknown placeholder", "{user}:{pass}[-zip-{zip}]"},
+		{"no colon", "{user}{pass}[-country-{country}]"},
+		{"two colons", "{user}:{pass}:x"},
+		{"unclosed placeholder", "{user}:{pass"},
+		{"stray brace", "{user}:pass}"},
+		{"unclosed group", "{user}:{pass}[-country-{country}"},
+		{"stray bracket", "{user}:{pass}]"},
+		{"group without placeholder", "{user}:{pass}[-static]"},
+	}
+
+	for _, tt := range tests {
+		if _, err := ParseTemplate(tt.format); err == nil {
+			t.Errorf("%s: ParseTemplate(%q) succeeded, want error", tt.name, tt.format)
+		}
+	}
+}
+
+func TestEncode(t *testing.T) {
+	sticky := filters.Filters{Country: "us", Session: "abc123", Lifetime: 30 * time.Minute}
+	interval := filters.Filters{Session: "abc123", Rotation: filters.RotateInterval, RotateEvery: 10 * time.Minute}
+
+	tests := []struct {
+		provider string
+		f        filters.Filters
+		want     string
+	}{
+		{"netnut", sticky, "-res-us-sid-abc123_lifetime-30m"},
+		{"netnut", interval, "-sid-abc123_rotate-10m"},
+		{"iproyal", sticky, "-country-us_session-abc123_lifetime-30m"},
+		{"iproyal", interval, "_session-abc123_rotate-10m"},
+		{"brightdata", sticky, "-country-us-session-abc123_lifetime-30m"},
+		{"oxylabs", sticky, "-cc-us-sessid-abc123-sesstime-30"},
+		{"oxylabs", filters.Filters{Country: "us"}, "-cc-us"},
+	}
+
+	for _, tt := range tests {
+		p, _ := Get(tt.provider)
+		got := p.Encode(tt.f)
+		if got != tt.want {
+			t.Errorf("%s Encode(%q) = %q, want %q", tt.provider, tt.f.String(), got, tt.want)
+			continue
+		}
+
+		parsed, err := filters.Parse(got)
+		if err != nil {
+			t.Errorf("%s: Parse(%q): %v", tt.provider, got, err)
+			continue
+		}
+		if parsed != tt.f {
+			t.Errorf("%s: Parse(%q) = %q, want %q", tt.provider, got, parsed.String(), tt.f.String())
+		}
+	}
+}
+
+func TestRegisterRejectsUnparsableFilters(t *testing.T) {
+	err := Register(&Provider{
+		Name:     "test-unparsable",
+		Template: "{user}:{pass}[-geo-{country}]",
+	})
+	if err == nil {
+		t.Error("Register accepted a template whose filters the worker cannot parse")
+	}
+}
@@ -0,0 +1,199 @@
+// Package schema defines the config that captain sends to workers. Both
+// binaries import it so the two sides can never disagree on field names.
+//
+// Compatibility rules:
+//
+//   - Adding an optional field whose zero value keeps the old behaviour is
+//     backwards compatible and does not change SchemaVersion. Readers must
+//     ignore fields they do not know.
+//   - Renaming or removing a field, changing its type or meaning, or adding
+//     a field that readers must understand bumps SchemaVersion.
+//   - A reader accepts configs with MinSchemaVersion <= schema_version <=
+//     SchemaVersion and rejects everything else, keeping its previous config.
+package schema
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/pubudu2003060/go-proxy-prototype/provider"
+)
+
+const (
+	SchemaVersion    = 1
+	MinSchemaVersion = 1
+)
+
+// Protocols an upstream can be reached with. An empty Out.Protocol means
+// ProtocolHTTP.
+const (
+	ProtocolHTTP   = "http"
+	ProtocolSOCKS5 = "socks5"
+)
+
+// Strategies a pool can spread connections over its outs with. An empty
+// Pool.Strategy means StrategyWeighted.
+const (
+	StrategyWeighted  = "weighted"
+	StrategyLeastConn = "least_conn"
+	StrategyEWMA      = "ewma"
+)
+
+// Config is the body of GET /api/v1/config.
+type Config struct {
+	SchemaVersion int              `json:"schema_version"`
+	Version       int64            `json:"version"`
+	Pools         map[string]*Pool `json:"pools"`
+}
+
+type Pool struct {
+	Name      string `json:"name"`
+	Region    string `json:"region"`
+	Tag       string `json:"tag"`
+	Subdomain string `json:"subdomain"`
+	CC3       string `json:"cc3"`
+	PortStart int    `json:"port_start"`
+	PortEnd   int    `json:"port_end"`
+	Flag      int    `json:"flag"`
+	Outs      []Out  `json:"outs"`
+	// Provider names the upstream provider in the provider registry. It
+	// decides how filters are encoded and the default upstream port.
+	Provider string `json:"provider,omitempty"`
+	// Strategy picks the out for each connection: by weight, by fewest
+	// connections in flight, or by peak EWMA of time to first byte. Both
+	// load-aware strategies scale the load by the out's weight.
+	Strategy string `json:"strategy,omitempty"`
+}
+
+// Out is one upstream endpoint of a pool. Format is a provider.Template
+// for the upstream credentials, filled from Username, Password and the
+// request's filters. An empty Format uses the pool provider's template and
+// a Format without placeholders is the older "user:pass-%s" form.
+type Out struct {
+	Format       string `json:"format"`
+	Username     string `json:"username,omitempty"`
+	Password     string `json:"password,omitempty"`
+	UpstreamPort int    `json:"upstream_port"`
+	Domain       string `json:"domain"`
+	Weight       int    `json:"weight"`
+	Protocol     string `json:"protocol,omitempty"`
+	// UDP is set when the upstream relays UDP through SOCKS5 UDP ASSOCIATE.
+	UDP bool `json:"udp,omitempty"`
+}
+
+func NewConfig(version int64, pools map[string]*Pool) *Config {
+	return &Config{
+		SchemaVersion: SchemaVersion,
+		Version:       version,
+		Pools:         pools,
+	}
+}
+
+// Check rejects a config this build cannot understand, either because of
+// its schema version or because a pool is missing required fields.
+func (c *Config) Check() error {
+	if c.SchemaVersion < MinSchemaVersion || c.SchemaVersion > SchemaVersion {
+		return fmt.Errorf("unsupported schema version %d, want %d to %d", c.SchemaVersion, MinSchemaVersion, SchemaVersion)
+	}
+	if c.Pools == nil {
+		return errors.New("config has no pools field")
+	}
+
+	for key, pool := range c.Pools {
+		if pool == nil {
+			return fmt.Errorf("pool %s is empty", key)
+		}
+		if pool.Name != key {
+			return fmt.Errorf("pool %s is keyed as %s", pool.Name, key)
+		}
+		if err := pool.Validate(); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (p *Pool) Validate() error {
+	if p.Name == "" {
+		return errors.New("pool name is required")
+	}
+	if p.Subdomain == "" {
+		return fmt.Errorf("pool %s: subdomain is required", p.Name)
+	}
+	if !validPort(p.PortStart) || !validPort(p.PortEnd) || p.PortEnd < p.PortStart {
+		return fmt.Errorf("pool %s: invalid port range %d-%d", p.Name, p.PortStart, p.PortEnd)
+	}
+	if len(p.Outs) == 0 {
+		return fmt.Errorf("pool %s: at least one out is required", p.Name)
+	}
+	if p.Provider != "" {
+		if _, ok := provider.Get(p.Provider); !ok {
+			return fmt.Errorf("pool %s: unknown provider %q, want one of %s", p.Name, p.Provider, strings.Join(provider.Names(), ", "))
+		}
+	}
+
+	switch p.Strategy {
+	case "", StrategyWeighted, StrategyLeastConn, StrategyEWMA:
+	default:
+		return fmt.Errorf("pool %s: unknown strategy %q", p.Name, p.Strategy)
+	}
+
+	for i, out := range p.Outs {
+		if err := out.Validate(); err != nil {
+			return fmt.Errorf("pool %s: out %d: %w", p.Name, i, err)
+		}
+		if !validPort(p.UpstreamPort(&out)) {
+			return fmt.Errorf("pool %s: out %d: upstream port is required without a provider default", p.Name, i)
+		}
+	}
+
+	return nil
+}
+
+// UpstreamPort returns the port to dial for out, falling back to the
+// provider's default when out does not set one.
+func (p *Pool) UpstreamPort(out *Out) int {
+	if out.UpstreamPort != 0 {
+		return out.UpstreamPort
+	}
+	if prov, ok := provider.Get(p.Provider); ok {
+		return prov.DefaultPort
+	}
+	return 0
+}
+
+func (o *Out) Validate() error {
+	if o.Domain == "" {
+		return errors.New("domain is required")
+	}
+	if o.Format == "" && o.Username == "" {
+		return errors.New("format or username is required")
+	}
+	if provider.IsTemplate(o.Format) {
+		if _, err := provider.ParseTemplate(o.Format); err != nil {
+			return fmt.Errorf("invalid format: %w", err)
+		}
+	}
+	if o.UpstreamPort != 0 && !validPort(o.UpstreamPort) {
+		return fmt.Errorf("invalid upstream port %d", o.UpstreamPort)
+	}
+	if o.Weight < 0 {
+		return fmt.Errorf("invalid weight %d", o.Weight)
+	}
+	switch o.Protocol {
+	case "", ProtocolHTTP, ProtocolSOCKS5:
+	default:
+		return fmt.Errorf("unsupported protocol %q", o.Protocol)
+	}
+	if o.UDP && o.Protocol != ProtocolSOCKS5 {
+		return errors.New("udp requires the socks5 protocol")
+	}
+
+	return nil
+}
+
+func validPort(port int) bool {
+	return port > 0 && port <= 65535
+}
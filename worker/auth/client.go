@@ -4,46 +4,122 @@ import (
 	"bytes"
 	"encoding/json"
 	"fmt"
+	"log"
 	"net/http"
+	"sync"
+	"time"
 
+	"github.com/pubudu2003060/go-proxy-prototype/worker/cache"
 	"github.com/pubudu2003060/go-proxy-prototype/worker/models"
 )
 
 type AuthClient struct {
 	captainURL string
+	store      *cache.Store
+	maxStale   time.Duration
+	degraded   bool
+	lastError  string
+	mu         sync.RWMutex
 }
 
-func NewAuthClient(captainURL string) *AuthClient {
+type Status struct {
+	Degraded      bool   `json:"degraded"`
+	CachedEntries int    `json:"cached_entries"`
+	LastError     string `json:"last_error,omitempty"`
+}
+
+// NewAuthClient falls back to successful results cached in store, for at
+// most maxStale, when captain cannot be reached.
+func NewAuthClient(captainURL string, store *cache.Store, maxStale time.Duration) *AuthClient {
 	return &AuthClient{
 		captainURL: captainURL,
+		store:      store,
+		maxStale:   maxStale,
 	}
 }
 
 func (c *AuthClient) Authenticate(username, password string) (*models.AuthResponse, error) {
+	authResp, err := c.authenticateWithCaptain(username, password)
+	if err != nil {
+		c.setDegraded(err)
+		return c.authenticateFromCache(username, password, err)
+	}
+	c.setDegraded(nil)
+
+	if authResp.Success {
+		c.store.SaveAuth(username, password, authResp, c.maxStale)
+		return authResp, nil
+	}
+
+	c.store.DeleteAuth(username, password)
+	return nil, fmt.Errorf("authentication faild")
+}
+
+func (c *AuthClient) authenticateWithCaptain(username, password string) (*models.AuthResponse, error) {
 	reqBody := models.AuthRequest{
 		Username: username,
 		Password: password,
 	}
 
-	jsonData,err := json.Marshal(reqBody)
+	jsonData, err := json.Marshal(reqBody)
 	if err != nil {
-		return nil,err
+		return nil, err
 	}
 
-	resp,err := http.Post(c.captainURL+"/api/v1/auth","application/json",bytes.NewBuffer(jsonData))
+	resp, err := http.Post(c.captainURL+"/api/v1/auth", "application/json", bytes.NewBuffer(jsonData))
 	if err != nil {
-		return nil,err
+		return nil, err
 	}
 	defer resp.Body.Close()
-	
+
+	if resp.StatusCode >= http.StatusInternalServerError {
+		return nil, fmt.Errorf("captain returned status %d", resp.StatusCode)
+	}
+
 	var authResp models.AuthResponse
-	if err := json.NewDecoder(resp.Body).Decode(&authResp);err != nil {
-		return nil,err
+	if err := json.NewDecoder(resp.Body).Decode(&authResp); err != nil {
+		return nil, err
 	}
 
-	if authResp.Success {
-   		return &authResp,nil
+	return &authResp, nil
+}
+
+func (c *AuthClient) authenticateFromCache(username, password string, cause error) (*models.AuthResponse, error) {
+	entry, ok := c.store.Auth(username, password)
+	if !ok || time.Since(entry.CachedAt) > c.maxStale {
+		return nil, fmt.Errorf("captain unreachable and no cached auth: %w", cause)
+	}
+
+	log.Printf("Captain unreachable, using cached auth for %s from %s", username, entry.CachedAt.Format(time.RFC3339))
+	authResp := entry.Response
+	return &authResp, nil
+}
+
+// InvalidateUser forgets cached results for userID so a changed or
+// removed user cannot keep authenticating from cache during an outage.
+func (c *AuthClient) InvalidateUser(userID string) {
+	c.store.DeleteAuthForUser(userID)
+}
+
+func (c *AuthClient) setDegraded(err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.degraded = err != nil
+	if err != nil {
+		c.lastError = err.Error()
+	} else {
+		c.lastError = ""
 	}
+}
 
-	return nil,fmt.Errorf("authentication faild")
-}
\ No newline at end of file
+func (c *AuthClient) Status() Status {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	return Status{
+		Degraded:      c.degraded,
+		CachedEntries: c.store.AuthCount(),
+		LastError:     c.lastError,
+	}
+}
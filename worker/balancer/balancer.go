@@ -0,0 +1,271 @@
+// Package balancer spreads connections over the outs of a pool.
+package balancer
+
+import (
+	"math"
+	"net"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/pubudu2003060/go-proxy-prototype/schema"
+	"github.com/pubudu2003060/go-proxy-prototype/worker/models"
+)
+
+// ewmaDecay is how quickly old time-to-first-byte samples stop counting
+// once an out gets faster again.
+const ewmaDecay = 10 * time.Second
+
+// ewmaDefault is the time to first byte assumed of an out with no samples
+// yet, so that it does not look free.
+const ewmaDefault = time.Second
+
+// ewmaPenalty is the sample a failed connection counts as, so an out that
+// only fails is avoided rather than never getting a sample.
+const ewmaPenalty = 10 * time.Second
+
+// Balancer picks outs with the pool's strategy. The weighted strategy is
+// smooth weighted round-robin, the nginx algorithm: every pick adds each
+// out's weight to its current score, takes the highest score and
+// subtracts the total weight from it. Over any run of total-weight picks
+// each out is chosen weight times, interleaved rather than in bursts.
+//
+// The least_conn and ewma strategies take the out with the lowest load
+// divided by its weight, where the load is the connections in flight or
+// the peak EWMA of time to first byte times the connections in flight.
+// Failed connections count as slow ones. Ties go round-robin.
+type Balancer struct {
+	pools map[string]*poolState
+	loads map[string]*load
+	mu    sync.Mutex
+}
+
+type poolState struct {
+	pool    *models.Pool
+	weights []int
+	current []int
+	offset  int
+}
+
+// load is tracked per upstream address rather than per pool so outs
+// shared by pools see all their traffic.
+type load struct {
+	inFlight   int
+	ewma       float64 // seconds
+	observedAt time.Time
+}
+
+// Load is the tracked load of one upstream.
+type Load struct {
+	Upstream string  `json:"upstream"`
+	InFlight int     `json:"in_flight"`
+	TTFBMs   float64 `json:"ttfb_ms"`
+}
+
+func New() *Balancer {
+	return &Balancer{
+		pools: make(map[string]*poolState),
+		loads: make(map[string]*load),
+	}
+}
+
+func addr(out *models.Out) string {
+	return net.JoinHostPort(out.Domain, strconv.Itoa(out.UpstreamPort))
+}
+
+// Reset drops the state of every pool. ConfigManager calls it when it
+// swaps in new pools so weights are recomputed from the new config. Loads
+// of outs that are gone are dropped once nothing is in flight.
+func (b *Balancer) Reset(pools map[string]*models.Pool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.pools = make(map[string]*poolState, len(pools))
+
+	keep := make(map[string]bool)
+	for _, pool := range pools {
+		for i := range pool.Outs {
+			keep[addr(&pool.Outs[i])] = true
+		}
+	}
+	for k, l := range b.loads {
+		if !keep[k] && l.inFlight == 0 {
+			delete(b.loads, k)
+		}
+	}
+}
+
+// Next returns the index in pool.Outs of the next out to use, or -1 when
+// the pool has no outs.
+func (b *Balancer) Next(pool *models.Pool) int {
+	return b.NextExcept(pool, nil)
+}
+
+// NextExcept is Next over the outs whose index is not in skip. It returns
+// -1 when no out is left.
+func (b *Balancer) NextExcept(pool *models.Pool, skip map[int]bool) int {
+	if len(pool.Outs) == 0 {
+		return -1
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	state, ok := b.pools[pool.Name]
+	if !ok || state.pool != pool {
+		state = newPoolState(pool)
+		b.pools[pool.Name] = state
+	}
+
+	switch pool.Strategy {
+	case schema.StrategyLeastConn:
+		return b.leastLoaded(state, skip, func(l *load) float64 {
+			return float64(l.inFlight + 1)
+		})
+	case schema.StrategyEWMA:
+		return b.leastLoaded(state, skip, func(l *load) float64 {
+			ewma := l.ewma
+			if l.observedAt.IsZero() {
+				ewma = ewmaDefault.Seconds()
+			}
+			return ewma * float64(l.inFlight+1)
+		})
+	default:
+		return state.weighted(skip)
+	}
+}
+
+func (state *poolState) weighted(skip map[int]bool) int {
+	best, total := -1, 0
+	for i, weight := range state.weights {
+		if weight == 0 || skip[i] {
+			continue
+		}
+		state.current[i] += weight
+		total += weight
+		if best < 0 || state.current[i] > state.current[best] {
+			best = i
+		}
+	}
+	if best >= 0 {
+		state.current[best] -= total
+	}
+
+	return best
+}
+
+func (b *Balancer) leastLoaded(state *poolState, skip map[int]bool, cost func(l *load) float64) int {
+	n := len(state.weights)
+	best, bestCost := -1, 0.0
+	for j := range n {
+		i := (state.offset + j) % n
+		weight := state.weights[i]
+		if weight == 0 || skip[i] {
+			continue
+		}
+		c := cost(b.load(&state.pool.Outs[i])) / float64(weight)
+		if best < 0 || c < bestCost {
+			best, bestCost = i, c
+		}
+	}
+	if best >= 0 {
+		state.offset = best + 1
+	}
+
+	return best
+}
+
+func (b *Balancer) load(out *models.Out) *load {
+	k := addr(out)
+	l, ok := b.loads[k]
+	if !ok {
+		l = &load{}
+		b.loads[k] = l
+	}
+	return l
+}
+
+// Begin counts a connection through out as in flight until End.
+func (b *Balancer) Begin(out *models.Out) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.load(out).inFlight++
+}
+
+func (b *Balancer) End(out *models.Out) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if l := b.load(out); l.inFlight > 0 {
+		l.inFlight--
+	}
+}
+
+// Observe records the time to first byte of a connection through out.
+// The peak EWMA jumps to a slower sample at once and decays towards
+// faster ones, so an out that turns slow is avoided straight away.
+func (b *Balancer) Observe(out *models.Out, ttfb time.Duration) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	l := b.load(out)
+	now := time.Now()
+	sample := ttfb.Seconds()
+
+	if sample > l.ewma {
+		l.ewma = sample
+	} else {
+		w := math.Exp(-now.Sub(l.observedAt).Seconds() / ewmaDecay.Seconds())
+		l.ewma = l.ewma*w + sample*(1-w)
+	}
+	l.observedAt = now
+}
+
+// Fail records a connection through out that failed as a slow one.
+func (b *Balancer) Fail(out *models.Out) {
+	b.Observe(out, ewmaPenalty)
+}
+
+func (b *Balancer) Loads() []Load {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	loads := make([]Load, 0, len(b.loads))
+	for k, l := range b.loads {
+		loads = append(loads, Load{
+			Upstream: k,
+			InFlight: l.inFlight,
+			TTFBMs:   l.ewma * 1000,
+		})
+	}
+	sort.Slice(loads, func(i, j int) bool {
+		return loads[i].Upstream < loads[j].Upstream
+	})
+
+	return loads
+}
+
+// newPoolState takes the weights from pool. Outs with weight 0 are never
+// picked unless every out has weight 0, in which case all count equally.
+func newPoolState(pool *models.Pool) *poolState {
+	state := &poolState{
+		pool:    pool,
+		weights: make([]int, len(pool.Outs)),
+		current: make([]int, len(pool.Outs)),
+	}
+
+	total := 0
+	for i, out := range pool.Outs {
+		state.weights[i] = out.Weight
+		total += out.Weight
+	}
+	if total == 0 {
+		for i := range state.weights {
+			state.weights[i] = 1
+		}
+	}
+
+	return state
+}
@@ -0,0 +1,147 @@
+package balancer
+
+import (
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/pubudu2003060/go-proxy-prototype/schema"
+	"github.com/pubudu2003060/go-proxy-prototype/worker/models"
+)
+
+func testPool(weights ...int) *models.Pool {
+	pool := &models.Pool{Name: "test"}
+	for i, w := range weights {
+		pool.Outs = append(pool.Outs, models.Out{
+			Domain:       "10.0.0." + strconv.Itoa(i+1),
+			UpstreamPort: 8000,
+			Weight:       w,
+		})
+	}
+	return pool
+}
+
+// counts calls Next n times and returns how often each out was picked.
+func counts(b *Balancer, pool *models.Pool, n int) []int {
+	got := make([]int, len(pool.Outs))
+	for range n {
+		got[b.Next(pool)]++
+	}
+	return got
+}
+
+func equal(a, b []int) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func TestNextWeighted(t *testing.T) {
+	const rounds = 10
+
+	tests := []struct {
+		weights []int
+		want    []int // picks per round of total weight
+	}{
+		{[]int{1}, []int{1}},
+		{[]int{1, 1, 1}, []int{1, 1, 1}},
+		{[]int{5, 1, 1}, []int{5, 1, 1}},
+		{[]int{100, 50, 25}, []int{100, 50, 25}},
+		{[]int{3, 0, 2}, []int{3, 0, 2}},
+		{[]int{0, 7, 0}, []int{0, 7, 0}},
+		{[]int{0, 0, 0}, []int{1, 1, 1}},
+	}
+
+	for _, tt := range tests {
+		total := 0
+		for _, w := range tt.want {
+			total += w
+		}
+
+		b := New()
+		pool := testPool(tt.weights...)
+		for round := range rounds {
+			if got := counts(b, pool, total); !equal(got, tt.want) {
+				t.Errorf("weights %v round %d: picks %v, want %v", tt.weights, round, got, tt.want)
+				break
+			}
+		}
+	}
+}
+
+func TestNextInterleaves(t *testing.T) {
+	b := New()
+	pool := testPool(5, 1, 1)
+
+	// The nginx sequence for weights 5, 1 and 1.
+	want := []int{0, 0, 1, 0, 2, 0, 0}
+	for i, w := range want {
+		if got := b.Next(pool); got != w {
+			t.Fatalf("pick %d = %d, want %d", i, got, w)
+		}
+	}
+}
+
+func TestNextExcept(t *testing.T) {
+	b := New()
+	pool := testPool(5, 1, 1)
+
+	for range 20 {
+		if got := b.NextExcept(pool, map[int]bool{0: true}); got == 0 {
+			t.Fatal("NextExcept picked a skipped out")
+		}
+	}
+	if got := b.NextExcept(pool, map[int]bool{0: true, 1: true, 2: true}); got != -1 {
+		t.Errorf("NextExcept with every out skipped = %d, want -1", got)
+	}
+	if got := b.Next(&models.Pool{Name: "empty"}); got != -1 {
+		t.Errorf("Next on an empty pool = %d, want -1", got)
+	}
+}
+
+func TestNextLeastConn(t *testing.T) {
+	b := New()
+	pool := testPool(1, 1, 2)
+	pool.Strategy = schema.StrategyLeastConn
+
+	// Out 2 takes two connections for every one of the others.
+	got := make([]int, len(pool.Outs))
+	for range 8 {
+		i := b.Next(pool)
+		got[i]++
+		b.Begin(&pool.Outs[i])
+	}
+	if want := []int{2, 2, 4}; !equal(got, want) {
+		t.Errorf("in flight %v, want %v", got, want)
+	}
+}
+
+func TestNextEWMAAvoidsFailingOut(t *testing.T) {
+	b := New()
+	pool := testPool(1, 1)
+	pool.Strategy = schema.StrategyEWMA
+
+	// Out 0 fails every connection, out 1 answers in 50ms.
+	got := make([]int, len(pool.Outs))
+	for range 100 {
+		i := b.Next(pool)
+		got[i]++
+		out := &pool.Outs[i]
+		b.Begin(out)
+		if i == 0 {
+			b.Fail(out)
+		} else {
+			b.Observe(out, 50*time.Millisecond)
+		}
+		b.End(out)
+	}
+	if got[0] > 1 {
+		t.Errorf("failing out picked %d times of 100, want at most 1", got[0])
+	}
+}
@@ -0,0 +1,64 @@
+package balancer
+
+import (
+	"hash/fnv"
+	"math"
+
+	"github.com/pubudu2003060/go-proxy-prototype/worker/models"
+)
+
+// Rendezvous returns the index in pool.Outs that key hashes to, ignoring
+// outs whose index is in skip, or -1 when no out is left. It needs no
+// state, so every worker maps a key to the same out, and adding or
+// removing an out only moves the keys that hash to it.
+//
+// This is weighted rendezvous hashing: each out scores
+// -weight/ln(h) for a hash h of key and the out's address in (0, 1), and
+// the highest score wins. An out gets keys in proportion to its weight.
+// Weight 0 is treated as in Next.
+func Rendezvous(pool *models.Pool, key string, skip map[int]bool) int {
+	allZero := true
+	for _, out := range pool.Outs {
+		if out.Weight > 0 {
+			allZero = false
+			break
+		}
+	}
+
+	best, bestScore := -1, 0.0
+	for i := range pool.Outs {
+		weight := pool.Outs[i].Weight
+		if allZero {
+			weight = 1
+		}
+		if weight == 0 || skip[i] {
+			continue
+		}
+
+		score := -float64(weight) / math.Log(unitHash(key, addr(&pool.Outs[i])))
+		if best < 0 || score > bestScore {
+			best, bestScore = i, score
+		}
+	}
+
+	return best
+}
+
+// unitHash hashes key and out to a float in (0, 1).
+func unitHash(key, out string) float64 {
+	h := fnv.New64a()
+	h.Write([]byte(key))
+	h.Write([]byte{0})
+	h.Write([]byte(out))
+
+	// FNV alone is poorly mixed in the high bits for similar inputs, so
+	// finish with the splitmix64 mixer.
+	x := h.Sum64()
+	x ^= x >> 30
+	x *= 0xbf58476d1ce4e5b9
+	x ^= x >> 27
+	x *= 0x94d049bb133111eb
+	x ^= x >> 31
+
+	return (float64(x>>11) + 0.5) / (1 << 53)
+}
@@ -0,0 +1,82 @@
+package balancer
+
+import (
+	"math"
+	"strconv"
+	"testing"
+)
+
+func TestRendezvousProportional(t *testing.T) {
+	const keys = 100000
+
+	tests := []struct {
+		weights []int
+		want    []float64 // share of keys
+	}{
+		{[]int{1, 1, 1, 1}, []float64{0.25, 0.25, 0.25, 0.25}},
+		{[]int{1, 2, 1}, []float64{0.25, 0.5, 0.25}},
+		{[]int{100, 50, 25, 25}, []float64{0.5, 0.25, 0.125, 0.125}},
+		{[]int{3, 0, 1}, []float64{0.75, 0, 0.25}},
+		{[]int{0, 0}, []float64{0.5, 0.5}},
+	}
+
+	for _, tt := range tests {
+		pool := testPool(tt.weights...)
+		got := make([]int, len(pool.Outs))
+		for k := range keys {
+			got[Rendezvous(pool, "user\x00"+strconv.Itoa(k), nil)]++
+		}
+
+		for i, share := range tt.want {
+			if share == 0 {
+				if got[i] != 0 {
+					t.Errorf("weights %v: out %d with weight 0 got %d keys", tt.weights, i, got[i])
+				}
+				continue
+			}
+			if diff := math.Abs(float64(got[i])/keys - share); diff > 0.01 {
+				t.Errorf("weights %v: out %d got %.3f of keys, want %.3f", tt.weights, i, float64(got[i])/keys, share)
+			}
+		}
+	}
+}
+
+func TestRendezvousStable(t *testing.T) {
+	const keys = 10000
+
+	before := testPool(1, 1, 1)
+	after := testPool(1, 1, 1, 1)
+
+	moved := 0
+	for k := range keys {
+		key := strconv.Itoa(k)
+		was, is := Rendezvous(before, key, nil), Rendezvous(after, key, nil)
+		if was != is {
+			if is != 3 {
+				t.Fatalf("key %s moved from out %d to old out %d", key, was, is)
+			}
+			moved++
+		}
+	}
+
+	// Only the new out's quarter of the keys may move.
+	if share := float64(moved) / keys; math.Abs(share-0.25) > 0.02 {
+		t.Errorf("adding an out moved %.3f of keys, want 0.25", share)
+	}
+}
+
+func TestRendezvousSkip(t *testing.T) {
+	pool := testPool(1, 1, 1)
+
+	for k := range 1000 {
+		key := strconv.Itoa(k)
+		first := Rendezvous(pool, key, nil)
+		next := Rendezvous(pool, key, map[int]bool{first: true})
+		if next == first || next < 0 {
+			t.Fatalf("key %s: skipping out %d gave %d", key, first, next)
+		}
+	}
+	if got := Rendezvous(pool, "k", map[int]bool{0: true, 1: true, 2: true}); got != -1 {
+		t.Errorf("Rendezvous with every out skipped = %d, want -1", got)
+	}
+}
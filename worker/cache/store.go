@@ -0,0 +1,226 @@
+package cache
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/pubudu2003060/go-proxy-prototype/worker/models"
+)
+
+// Store keeps the last known good config and recent successful auth
+// results on disk so the worker can keep serving while captain is down.
+// Refreshed auth results stay in memory until the next Flush.
+type Store struct {
+	path     string
+	snapshot snapshot
+	dirty    bool
+	mu       sync.Mutex
+}
+
+type snapshot struct {
+	Pools    map[string]*models.Pool `json:"pools"`
+	SyncedAt time.Time               `json:"synced_at"`
+	Auth     map[string]*AuthEntry   `json:"auth"`
+}
+
+type AuthEntry struct {
+	Response models.AuthResponse `json:"response"`
+	CachedAt time.Time           `json:"cached_at"`
+}
+
+func NewStore(path string) *Store {
+	s := &Store{
+		path: path,
+		snapshot: snapshot{
+			Pools: make(map[string]*models.Pool),
+			Auth:  make(map[string]*AuthEntry),
+		},
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if !errors.Is(err, os.ErrNotExist) {
+			log.Printf("Failed to read state file %s: %v", path, err)
+		}
+		return s
+	}
+
+	var snap snapshot
+	if err := json.Unmarshal(data, &snap); err != nil {
+		log.Printf("Failed to decode state file %s: %v", path, err)
+		return s
+	}
+	if snap.Pools != nil {
+		s.snapshot.Pools = snap.Pools
+	}
+	if snap.Auth != nil {
+		s.snapshot.Auth = snap.Auth
+	}
+	s.snapshot.SyncedAt = snap.SyncedAt
+
+	log.Printf("Loaded state from %s: %d pools, %d auth entries", path, len(s.snapshot.Pools), len(s.snapshot.Auth))
+	return s
+}
+
+func (s *Store) Pools() (map[string]*models.Pool, time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	result := make(map[string]*models.Pool)
+	for k, v := range s.snapshot.Pools {
+		result[k] = v
+	}
+
+	return result, s.snapshot.SyncedAt
+}
+
+func (s *Store) SavePools(pools map[string]*models.Pool, syncedAt time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.snapshot.Pools = pools
+	s.snapshot.SyncedAt = syncedAt
+	s.persist()
+}
+
+func (s *Store) Auth(username, password string) (*AuthEntry, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	entry, ok := s.snapshot.Auth[authKey(username, password)]
+	return entry, ok
+}
+
+// SaveAuth records a successful authentication and drops entries older
+// than maxAge so the file does not grow without bound. Only new
+// credentials are written at once; refreshing a known entry waits for
+// the next Flush, as it runs on every proxied request.
+func (s *Store) SaveAuth(username, password string, resp *models.AuthResponse, maxAge time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	for k, v := range s.snapshot.Auth {
+		if now.Sub(v.CachedAt) > maxAge {
+			delete(s.snapshot.Auth, k)
+		}
+	}
+
+	key := authKey(username, password)
+	_, known := s.snapshot.Auth[key]
+	s.snapshot.Auth[key] = &AuthEntry{
+		Response: *resp,
+		CachedAt: now,
+	}
+	if known {
+		s.dirty = true
+		return
+	}
+	s.persist()
+}
+
+func (s *Store) DeleteAuth(username, password string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	key := authKey(username, password)
+	if _, ok := s.snapshot.Auth[key]; !ok {
+		return
+	}
+
+	delete(s.snapshot.Auth, key)
+	s.persist()
+}
+
+func (s *Store) DeleteAuthForUser(userID string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	removed := false
+	for k, v := range s.snapshot.Auth {
+		if v.Response.UserID == userID {
+			delete(s.snapshot.Auth, k)
+			removed = true
+		}
+	}
+
+	if removed {
+		s.persist()
+	}
+}
+
+// Start flushes refreshed auth results to disk every interval.
+func (s *Store) Start(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		s.Flush()
+	}
+}
+
+// Flush writes the state file if anything changed since it was written.
+func (s *Store) Flush() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.dirty {
+		s.persist()
+	}
+}
+
+func (s *Store) AuthCount() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return len(s.snapshot.Auth)
+}
+
+// persist writes the snapshot to a temp file and renames it over the old
+// one so a crash never leaves a half written state file. Callers hold mu.
+func (s *Store) persist() {
+	s.dirty = false
+	if s.path == "" {
+		return
+	}
+
+	data, err := json.Marshal(s.snapshot)
+	if err != nil {
+		log.Printf("Failed to marshal state: %v", err)
+		return
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(s.path), filepath.Base(s.path)+".tmp")
+	if err != nil {
+		log.Printf("Failed to write state: %v", err)
+		return
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		log.Printf("Failed to write state: %v", err)
+		return
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		log.Printf("Failed to write state: %v", err)
+		return
+	}
+	if err := os.Rename(tmp.Name(), s.path); err != nil {
+		os.Remove(tmp.Name())
+		log.Printf("Failed to write state: %v", err)
+	}
+}
+
+// authKey hashes the credentials so plain text passwords never hit disk.
+func authKey(username, password string) string {
+	sum := sha256.Sum256([]byte(username + ":" + password))
+	return hex.EncodeToString(sum[:])
+}
@@ -2,76 +2,262 @@ package config
 
 import (
 	"encoding/json"
+	"fmt"
 	"log"
 	"net/http"
 	"sync"
 	"time"
 
+	"github.com/pubudu2003060/go-proxy-prototype/schema"
+	"github.com/pubudu2003060/go-proxy-prototype/worker/cache"
 	"github.com/pubudu2003060/go-proxy-prototype/worker/models"
 )
 
+// WorkerNameHeader tells captain which worker is asking for config.
+const WorkerNameHeader = "X-Worker-Name"
+
+// WorkerTokenHeader proves to captain that the worker is the one named.
+const WorkerTokenHeader = "X-Worker-Token"
+
 type ConfigManager struct {
+	// Token is the secret captain issued to this worker.
+	Token string
+
 	captainURL string
+	workerName string
 	pools      map[string]*models.Pool
-	mu sync.RWMutex
+	version    int64
+	etag       string
+	onUser     []func(userID string)
+	onPools    []func(pools map[string]*models.Pool)
+	onKill     []func(userID, session string, generation int)
+	store      *cache.Store
+	maxStale   time.Duration
+	syncedAt   time.Time
+	degraded   bool
+	lastError  string
+	syncing    sync.Mutex // one syncConfig at a time
+	mu         sync.RWMutex
+}
+
+type Status struct {
+	Degraded  bool      `json:"degraded"`
+	Pools     int       `json:"pools"`
+	Version   int64     `json:"version"`
+	SyncedAt  time.Time `json:"synced_at"`
+	Age       string    `json:"age"`
+	LastError string    `json:"last_error,omitempty"`
 }
 
-func NewConfigManager(captainURL string) *ConfigManager {
-	return &ConfigManager{
+// NewConfigManager starts from the pools saved in store, if they are not
+// older than maxStale, until the first sync with captain succeeds.
+func NewConfigManager(captainURL string, workerName string, store *cache.Store, maxStale time.Duration) *ConfigManager {
+	m := &ConfigManager{
 		captainURL: captainURL,
+		workerName: workerName,
 		pools:      make(map[string]*models.Pool),
+		store:      store,
+		maxStale:   maxStale,
 	}
+
+	pools, syncedAt := store.Pools()
+	if err := schema.NewConfig(0, pools).Check(); err != nil {
+		log.Printf("Ignoring cached config: %v", err)
+		return m
+	}
+	if len(pools) > 0 && time.Since(syncedAt) <= maxStale {
+		m.pools = pools
+		m.syncedAt = syncedAt
+		m.degraded = true
+		log.Printf("Serving %d cached pools from %s until captain is reachable", len(pools), syncedAt.Format(time.RFC3339))
+	}
+
+	return m
 }
 
 func (m *ConfigManager) StartSync(interval time.Duration) {
 	ticker := time.NewTicker(interval)
 	defer ticker.Stop()
-	
+
 	// Initial sync
 	m.syncConfig()
-	
+
 	for range ticker.C {
 		m.syncConfig()
 	}
 }
 
+// OnUserChange registers fn to be called when captain reports a change to
+// a user's policy on the config stream.
+func (m *ConfigManager) OnUserChange(fn func(userID string)) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.onUser = append(m.onUser, fn)
+}
+
+// OnSessionKill registers fn to be called when captain asks for a user's
+// sticky session to be dropped and moved to generation.
+func (m *ConfigManager) OnSessionKill(fn func(userID, session string, generation int)) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.onKill = append(m.onKill, fn)
+}
+
+// OnPoolsChange registers fn to be called with the new pools whenever the
+// manager swaps them in.
+func (m *ConfigManager) OnPoolsChange(fn func(pools map[string]*models.Pool)) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.onPools = append(m.onPools, fn)
+}
+
+func (m *ConfigManager) poolsChanged(pools map[string]*models.Pool) {
+	m.mu.RLock()
+	callbacks := m.onPools
+	m.mu.RUnlock()
+
+	for _, fn := range callbacks {
+		fn(pools)
+	}
+}
+
+// syncConfig runs one fetch at a time, as the ticker and the config
+// stream both call it, and never swaps in a version older than the one it
+// has. Captain's versions keep increasing across its restarts.
 func (m *ConfigManager) syncConfig() {
-	resp, err := http.Get(m.captainURL + "/api/v1/config")
+	m.syncing.Lock()
+	defer m.syncing.Unlock()
+
+	m.mu.RLock()
+	etag := m.etag
+	m.mu.RUnlock()
+
+	pools, version, newETag, err := m.fetchConfig(etag)
 	if err != nil {
 		log.Printf("Failed to sync config: %v", err)
+		m.markDegraded(err)
 		return
 	}
-	defer resp.Body.Close()
-	
-	var pools map[string]*models.Pool
-	if err := json.NewDecoder(resp.Body).Decode(&pools); err != nil {
-		log.Printf("Failed to decode config: %v", err)
+
+	now := time.Now()
+	m.mu.Lock()
+	m.syncedAt = now
+	m.degraded = false
+	m.lastError = ""
+	if pools == nil {
+		m.mu.Unlock()
+		return
+	}
+	if version < m.version {
+		m.mu.Unlock()
+		log.Printf("Ignoring config version %d older than %d", version, m.version)
 		return
 	}
-	
-	m.mu.Lock()
 	m.pools = pools
+	m.version = version
+	m.etag = newETag
 	m.mu.Unlock()
-	
-	log.Printf("Config synced, %d pools loaded", len(pools))
+
+	m.store.SavePools(pools, now)
+	m.poolsChanged(pools)
+
+	log.Printf("Config synced, %d pools loaded (version %d)", len(pools), version)
+}
+
+// fetchConfig returns nil pools when captain answers 304 for etag.
+func (m *ConfigManager) fetchConfig(etag string) (map[string]*models.Pool, int64, string, error) {
+	req, err := http.NewRequest(http.MethodGet, m.captainURL+"/api/v1/config", nil)
+	if err != nil {
+		return nil, 0, "", err
+	}
+	req.Header.Set(WorkerNameHeader, m.workerName)
+	req.Header.Set(WorkerTokenHeader, m.Token)
+	if etag != "" {
+		req.Header.Set("If-None-Match", etag)
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, 0, "", err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotModified {
+		return nil, 0, etag, nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, 0, "", fmt.Errorf("captain returned status %d", resp.StatusCode)
+	}
+
+	var config schema.Config
+	if err := json.NewDecoder(resp.Body).Decode(&config); err != nil {
+		return nil, 0, "", fmt.Errorf("decode config: %w", err)
+	}
+	if err := config.Check(); err != nil {
+		return nil, 0, "", fmt.Errorf("rejected config: %w", err)
+	}
+
+	return config.Pools, config.Version, resp.Header.Get("ETag"), nil
+}
+
+// markDegraded keeps the current pools while they are fresh enough and
+// drops them once they pass maxStale, so the worker never routes on
+// arbitrarily old config.
+func (m *ConfigManager) markDegraded(err error) {
+	m.mu.Lock()
+
+	m.degraded = true
+	m.lastError = err.Error()
+
+	if len(m.pools) == 0 || time.Since(m.syncedAt) <= m.maxStale {
+		m.mu.Unlock()
+		return
+	}
+
+	log.Printf("Cached config is older than %s, dropping %d pools", m.maxStale, len(m.pools))
+	m.pools = make(map[string]*models.Pool)
+	m.mu.Unlock()
+
+	m.poolsChanged(m.GetPools())
 }
 
 func (m *ConfigManager) GetPools() map[string]*models.Pool {
 	m.mu.RLock()
 	defer m.mu.RUnlock()
-	
+
 	// Return a copy
 	result := make(map[string]*models.Pool)
 	for k, v := range m.pools {
 		result[k] = v
 	}
-	
+
 	return result
 }
 
 func (m *ConfigManager) GetPool(name string) *models.Pool {
 	m.mu.RLock()
 	defer m.mu.RUnlock()
-	
+
 	return m.pools[name]
-}
\ No newline at end of file
+}
+
+func (m *ConfigManager) Status() Status {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	status := Status{
+		Degraded:  m.degraded,
+		Pools:     len(m.pools),
+		Version:   m.version,
+		SyncedAt:  m.syncedAt,
+		LastError: m.lastError,
+	}
+	if !m.syncedAt.IsZero() {
+		status.Age = time.Since(m.syncedAt).Round(time.Second).String()
+	}
+
+	return status
+}
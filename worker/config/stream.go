@@ -0,0 +1,114 @@
+package config
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/pubudu2003060/go-proxy-prototype/worker/models"
+)
+
+// Watch subscribes to captain's config stream and applies changes as soon
+// as they are pushed. It reconnects with backoff and never returns; the
+// polling in StartSync keeps working as a fallback while it is down.
+func (m *ConfigManager) Watch() {
+	backoff := time.Second
+	for {
+		start := time.Now()
+		err := m.watchOnce()
+		log.Printf("Config stream disconnected: %v", err)
+
+		if time.Since(start) > time.Minute {
+			backoff = time.Second
+		}
+		time.Sleep(backoff)
+		backoff *= 2
+		if backoff > 30*time.Second {
+			backoff = 30 * time.Second
+		}
+	}
+}
+
+func (m *ConfigManager) watchOnce() error {
+	req, err := http.NewRequest(http.MethodGet, m.captainURL+"/api/v1/config/stream", nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set(WorkerNameHeader, m.workerName)
+	req.Header.Set(WorkerTokenHeader, m.Token)
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("captain returned status %d", resp.StatusCode)
+	}
+
+	log.Println("Config stream connected")
+
+	var data strings.Builder
+	scanner := bufio.NewScanner(resp.Body)
+	for scanner.Scan() {
+		line := scanner.Text()
+
+		switch {
+		case line == "":
+			if data.Len() > 0 {
+				m.handleEvent(data.String())
+				data.Reset()
+			}
+		case strings.HasPrefix(line, "data:"):
+			if data.Len() > 0 {
+				data.WriteByte('\n')
+			}
+			data.WriteString(strings.TrimPrefix(strings.TrimPrefix(line, "data:"), " "))
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	return fmt.Errorf("stream closed by captain")
+}
+
+func (m *ConfigManager) handleEvent(data string) {
+	var event models.ConfigEvent
+	if err := json.Unmarshal([]byte(data), &event); err != nil {
+		log.Printf("Failed to decode config event: %v", err)
+		return
+	}
+
+	switch event.Type {
+	case models.EventPools, models.EventPing:
+		m.mu.RLock()
+		current := m.version
+		m.mu.RUnlock()
+
+		if event.Version != current {
+			m.syncConfig()
+		}
+	case models.EventUser:
+		m.mu.RLock()
+		handlers := m.onUser
+		m.mu.RUnlock()
+
+		for _, fn := range handlers {
+			fn(event.UserID)
+		}
+	case models.EventKillSession:
+		m.mu.RLock()
+		handlers := m.onKill
+		m.mu.RUnlock()
+
+		for _, fn := range handlers {
+			fn(event.UserID, event.Session, event.Generation)
+		}
+	}
+}
@@ -0,0 +1,221 @@
+// Package health tracks which upstream outs are usable. Real traffic and
+// periodic probes feed a circuit breaker per out: consecutive failures
+// open it and take the out out of rotation, and once OpenTimeout has
+// passed a half-open probe decides whether it comes back.
+package health
+
+import (
+	"log"
+	"net"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/pubudu2003060/go-proxy-prototype/worker/config"
+	"github.com/pubudu2003060/go-proxy-prototype/worker/models"
+)
+
+type State string
+
+const (
+	StateClosed   State = "closed"
+	StateOpen     State = "open"
+	StateHalfOpen State = "half_open"
+)
+
+// ProbeFunc connects to target through out and reports whether the
+// upstream handled it.
+type ProbeFunc func(pool *models.Pool, out *models.Out, target string, timeout time.Duration) error
+
+type Checker struct {
+	// ProbeTarget is the host:port probes connect to through each out.
+	ProbeTarget   string
+	ProbeInterval time.Duration
+	ProbeTimeout  time.Duration
+	// FailureThreshold consecutive failures open an out's circuit.
+	FailureThreshold int
+	// OpenTimeout is how long an open circuit waits before a half-open
+	// probe.
+	OpenTimeout time.Duration
+
+	configManager *config.ConfigManager
+	probe         ProbeFunc
+	breakers      map[string]*breaker
+	mu            sync.Mutex
+}
+
+type breaker struct {
+	state     State
+	failures  int
+	openedAt  time.Time
+	checkedAt time.Time
+	lastError string
+}
+
+func NewChecker(configManager *config.ConfigManager, probe ProbeFunc) *Checker {
+	return &Checker{
+		ProbeTarget:      "1.1.1.1:443",
+		ProbeInterval:    30 * time.Second,
+		ProbeTimeout:     10 * time.Second,
+		FailureThreshold: 3,
+		OpenTimeout:      time.Minute,
+		configManager:    configManager,
+		probe:            probe,
+		breakers:         make(map[string]*breaker),
+	}
+}
+
+func key(out *models.Out) string {
+	return net.JoinHostPort(out.Domain, strconv.Itoa(out.UpstreamPort))
+}
+
+// Start probes every out of the current pools each ProbeInterval.
+func (c *Checker) Start() {
+	ticker := time.NewTicker(c.ProbeInterval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		c.probeAll()
+	}
+}
+
+func (c *Checker) probeAll() {
+	type target struct {
+		pool *models.Pool
+		out  *models.Out
+	}
+
+	targets := make(map[string]target)
+	for _, pool := range c.configManager.GetPools() {
+		for i := range pool.Outs {
+			targets[key(&pool.Outs[i])] = target{pool: pool, out: &pool.Outs[i]}
+		}
+	}
+
+	var wg sync.WaitGroup
+	for _, t := range targets {
+		if !c.startProbe(t.out) {
+			continue
+		}
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			c.Record(t.out, c.probe(t.pool, t.out, c.ProbeTarget, c.ProbeTimeout))
+		}()
+	}
+	wg.Wait()
+}
+
+// startProbe reports whether out is due a probe, moving an open circuit
+// whose timeout has passed to half-open.
+func (c *Checker) startProbe(out *models.Out) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	b := c.breaker(out)
+	if b.state != StateOpen {
+		return true
+	}
+	if time.Since(b.openedAt) < c.OpenTimeout {
+		return false
+	}
+
+	b.state = StateHalfOpen
+	return true
+}
+
+func (c *Checker) breaker(out *models.Out) *breaker {
+	k := key(out)
+	b, ok := c.breakers[k]
+	if !ok {
+		b = &breaker{state: StateClosed}
+		c.breakers[k] = b
+	}
+	return b
+}
+
+// Healthy reports whether out's circuit is closed. Outs never seen are
+// healthy.
+func (c *Checker) Healthy(out *models.Out) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	b, ok := c.breakers[key(out)]
+	return !ok || b.state == StateClosed
+}
+
+// Record feeds the result of a probe or of real traffic through out into
+// its circuit.
+func (c *Checker) Record(out *models.Out, err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	b := c.breaker(out)
+	b.checkedAt = time.Now()
+
+	if err == nil {
+		if b.state != StateClosed {
+			log.Printf("Upstream %s recovered, closing circuit", key(out))
+		}
+		b.state = StateClosed
+		b.failures = 0
+		b.lastError = ""
+		return
+	}
+
+	b.failures++
+	b.lastError = err.Error()
+
+	switch {
+	case b.state == StateHalfOpen:
+		log.Printf("Upstream %s failed half-open probe: %v", key(out), err)
+		b.state = StateOpen
+		b.openedAt = b.checkedAt
+	case b.state == StateClosed && b.failures >= c.FailureThreshold:
+		log.Printf("Upstream %s failed %d times, opening circuit: %v", key(out), b.failures, err)
+		b.state = StateOpen
+		b.openedAt = b.checkedAt
+	}
+}
+
+// Prune forgets outs that are no longer in any pool.
+func (c *Checker) Prune(pools map[string]*models.Pool) {
+	keep := make(map[string]bool)
+	for _, pool := range pools {
+		for i := range pool.Outs {
+			keep[key(&pool.Outs[i])] = true
+		}
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for k := range c.breakers {
+		if !keep[k] {
+			delete(c.breakers, k)
+		}
+	}
+}
+
+func (c *Checker) Snapshot() []models.UpstreamHealth {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	snapshot := make([]models.UpstreamHealth, 0, len(c.breakers))
+	for k, b := range c.breakers {
+		snapshot = append(snapshot, models.UpstreamHealth{
+			Upstream:  k,
+			State:     string(b.state),
+			Failures:  b.failures,
+			CheckedAt: b.checkedAt,
+			LastError: b.lastError,
+		})
+	}
+	sort.Slice(snapshot, func(i, j int) bool {
+		return snapshot[i].Upstream < snapshot[j].Upstream
+	})
+
+	return snapshot
+}
@@ -0,0 +1,134 @@
+package heartbeat
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/pubudu2003060/go-proxy-prototype/worker/config"
+	"github.com/pubudu2003060/go-proxy-prototype/worker/health"
+	"github.com/pubudu2003060/go-proxy-prototype/worker/models"
+	"github.com/pubudu2003060/go-proxy-prototype/worker/session"
+	"github.com/pubudu2003060/go-proxy-prototype/worker/stats"
+)
+
+var errNotRegistered = errors.New("worker not registered")
+
+// Reporter registers the worker with captain and keeps sending
+// heartbeats with its load, the health of its upstreams and its sticky
+// sessions so captain can tell which workers are alive.
+type Reporter struct {
+	// Token is the secret captain issued to this worker.
+	Token string
+
+	captainURL   string
+	registration models.RegisterRequest
+	stats        *stats.Stats
+	health       *health.Checker
+	sessions     *session.Store
+}
+
+func NewReporter(captainURL string, registration models.RegisterRequest, stats *stats.Stats, health *health.Checker, sessions *session.Store) *Reporter {
+	return &Reporter{
+		captainURL:   captainURL,
+		registration: registration,
+		stats:        stats,
+		health:       health,
+		sessions:     sessions,
+	}
+}
+
+func (r *Reporter) Start(interval time.Duration) {
+	r.register(interval)
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	last := r.stats.Snapshot()
+	lastAt := time.Now()
+
+	for range ticker.C {
+		now := time.Now()
+		current := r.stats.Snapshot()
+		elapsed := now.Sub(lastAt).Seconds()
+
+		req := models.HeartbeatRequest{
+			Name: r.registration.Name,
+			Stats: models.WorkerStats{
+				ActiveConnections: current.ActiveConnections,
+				BytesInPerSec:     float64(current.BytesIn-last.BytesIn) / elapsed,
+				BytesOutPerSec:    float64(current.BytesOut-last.BytesOut) / elapsed,
+				StickySessions:    current.StickySessions,
+			},
+			Upstreams: r.health.Snapshot(),
+			Sessions:  r.sessions.Snapshot(),
+		}
+		last, lastAt = current, now
+
+		var resp models.HeartbeatResponse
+		err := r.post("/api/v1/workers/heartbeat", req, &resp)
+		if err == errNotRegistered {
+			log.Println("Captain does not know this worker, registering again")
+			r.register(interval)
+			continue
+		}
+		if err != nil {
+			log.Printf("Failed to send heartbeat: %v", err)
+			continue
+		}
+		if closed := r.sessions.Sync(resp.KilledSessions); closed > 0 {
+			log.Printf("Closed %d connections of sessions captain killed", closed)
+		}
+	}
+}
+
+// register retries until captain accepts the registration.
+func (r *Reporter) register(interval time.Duration) {
+	for {
+		err := r.post("/api/v1/workers/register", r.registration, nil)
+		if err == nil {
+			log.Printf("Registered with captain as %s", r.registration.Name)
+			return
+		}
+		log.Printf("Failed to register with captain: %v", err)
+		time.Sleep(interval)
+	}
+}
+
+// post sends body to captain and decodes the reply into out unless it is
+// nil.
+func (r *Reporter) post(path string, body, out any) error {
+	jsonData, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest(http.MethodPost, r.captainURL+path, bytes.NewBuffer(jsonData))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(config.WorkerTokenHeader, r.Token)
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+		if out == nil {
+			return nil
+		}
+		return json.NewDecoder(resp.Body).Decode(out)
+	case http.StatusNotFound:
+		return errNotRegistered
+	default:
+		return fmt.Errorf("captain returned status %d", resp.StatusCode)
+	}
+}
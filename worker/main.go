@@ -1,68 +1,251 @@
 package main
 
 import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"flag"
 	"log"
 	"net"
 	"net/http"
+	"os"
+	"os/signal"
 	"sync"
+	"syscall"
 	"time"
 
 	"github.com/pubudu2003060/go-proxy-prototype/worker/auth"
+	"github.com/pubudu2003060/go-proxy-prototype/worker/balancer"
+	"github.com/pubudu2003060/go-proxy-prototype/worker/cache"
 	"github.com/pubudu2003060/go-proxy-prototype/worker/config"
+	"github.com/pubudu2003060/go-proxy-prototype/worker/health"
+	"github.com/pubudu2003060/go-proxy-prototype/worker/heartbeat"
+	"github.com/pubudu2003060/go-proxy-prototype/worker/models"
 	"github.com/pubudu2003060/go-proxy-prototype/worker/proxy"
+	"github.com/pubudu2003060/go-proxy-prototype/worker/session"
+	"github.com/pubudu2003060/go-proxy-prototype/worker/stats"
 	"github.com/pubudu2003060/go-proxy-prototype/worker/usage"
 )
 
+const version = "0.1.0"
+
 func main() {
-	configManager := config.NewConfigManager("http://localhost:8080")
-	authClient := auth.NewAuthClient("http://localhost:8080")
+	workerName := flag.String("name", "asia", "worker name registered in captain")
+	workerToken := flag.String("token", os.Getenv("WORKER_TOKEN"), "token captain issued to this worker, defaults to $WORKER_TOKEN")
+	publicAddr := flag.String("public-addr", "", "address clients use to reach this worker")
+	muxAddr := flag.String("mux-addr", ":8000", "single port serving HTTP, SOCKS and TLS proxy clients, empty to disable")
+	httpAddr := flag.String("http-addr", "", "dedicated HTTP proxy port such as :8081, empty for the mux port only")
+	socksAddr := flag.String("socks-addr", "", "dedicated SOCKS proxy port such as :1080, empty for the mux port only")
+	tlsCert := flag.String("tls-cert", "", "certificate for TLS proxy clients on the mux port")
+	tlsKey := flag.String("tls-key", "", "private key for TLS proxy clients on the mux port")
+	retryAttempts := flag.Int("upstream-attempts", proxy.DefaultRetryPolicy.MaxAttempts, "upstreams tried per connection, 1 disables failover")
+	attemptTimeout := flag.Duration("upstream-attempt-timeout", proxy.DefaultRetryPolicy.AttemptTimeout, "time allowed to connect through one upstream")
+	retryTimeout := flag.Duration("upstream-timeout", proxy.DefaultRetryPolicy.TotalTimeout, "time allowed to connect through upstreams including retries")
+	probeTarget := flag.String("probe-target", "1.1.1.1:443", "host:port health probes connect to through each upstream")
+	probeInterval := flag.Duration("probe-interval", 30*time.Second, "time between health probes of each upstream")
+	failureThreshold := flag.Int("upstream-failures", 3, "consecutive failures that take an upstream out of rotation")
+	openTimeout := flag.Duration("upstream-open-timeout", time.Minute, "time an unhealthy upstream waits before it is probed again")
+	maxSessions := flag.Int("max-sessions", 100000, "sticky sessions kept before the least recently used is dropped, 0 for no limit")
+	sessionLifetime := flag.Duration("session-lifetime", 30*time.Minute, "lifetime of sticky sessions that do not ask for one")
+	flag.Parse()
+
+	if *muxAddr == "" && *httpAddr == "" && *socksAddr == "" {
+		log.Fatal("no proxy listener, set -mux-addr, -http-addr or -socks-addr")
+	}
+	if *workerToken == "" {
+		log.Fatal("no worker token, set -token or WORKER_TOKEN")
+	}
+
+	retry := proxy.RetryPolicy{
+		MaxAttempts:    *retryAttempts,
+		AttemptTimeout: *attemptTimeout,
+		TotalTimeout:   *retryTimeout,
+	}
+
+	store := cache.NewStore("worker-state.json")
+	configManager := config.NewConfigManager("http://localhost:8080", *workerName, store, 24*time.Hour)
+	configManager.Token = *workerToken
+	authClient := auth.NewAuthClient("http://localhost:8080", store, time.Hour)
 	usageReporter := usage.NewUsageReporter("http://localhost:8080")
+	workerStats := stats.New()
+
+	upstreamBalancer := balancer.New()
+	upstreamHealth := health.NewChecker(configManager, proxy.ProbeUpstream)
+	upstreamHealth.ProbeTarget = *probeTarget
+	upstreamHealth.ProbeInterval = *probeInterval
+	upstreamHealth.FailureThreshold = *failureThreshold
+	upstreamHealth.OpenTimeout = *openTimeout
+
+	sessions := session.NewStore(workerStats)
+	sessions.MaxSessions = *maxSessions
+	sessions.DefaultLifetime = *sessionLifetime
+
+	configManager.OnUserChange(authClient.InvalidateUser)
+	configManager.OnPoolsChange(upstreamBalancer.Reset)
+	configManager.OnPoolsChange(upstreamHealth.Prune)
+	configManager.OnSessionKill(func(userID, id string, generation int) {
+		closed := sessions.Kill(session.Key{UserID: userID, Session: id}, generation, time.Now().Add(session.KilledFor))
+		log.Printf("Killed session %s of user %s, closed %d connections", id, userID, closed)
+	})
+	go configManager.Watch()
+	go configManager.StartSync(30 * time.Second)
+	go upstreamHealth.Start()
+	go sessions.Start(time.Minute)
+	go store.Start(time.Minute)
+
+	httpProxy := proxy.NewHTTPProxy(configManager, authClient, usageReporter, workerStats, upstreamBalancer, upstreamHealth, sessions)
+	httpProxy.Retry = retry
+	httpHandler := http.HandlerFunc(httpProxy.HandleConnection)
+
+	socksProxy := proxy.NewSocksProxy(configManager, authClient, usageReporter, workerStats, upstreamBalancer, upstreamHealth, sessions)
+	socksProxy.Retry = retry
+	socksProxy.PublicAddr = *publicAddr
+	socksServer := proxy.NewConnServer(socksProxy, 10000)
+	go drainOnSignal(socksServer, store)
+
+	go startStatusServer(configManager, authClient, workerStats, upstreamBalancer, upstreamHealth, socksServer)
+
+	ports := map[string]int{"status": 8082}
+	for name, addr := range map[string]string{"mux": *muxAddr, "http": *httpAddr, "socks": *socksAddr} {
+		if _, port, err := net.SplitHostPort(addr); err == nil {
+			if n, err := net.LookupPort("tcp", port); err == nil {
+				ports[name] = n
+			}
+		}
+	}
+
+	reporter := heartbeat.NewReporter("http://localhost:8080", models.RegisterRequest{
+		Name:       *workerName,
+		Version:    version,
+		PublicAddr: *publicAddr,
+		Ports:      ports,
+	}, workerStats, upstreamHealth, sessions)
+	reporter.Token = *workerToken
+	go reporter.Start(10 * time.Second)
 
 	wg := sync.WaitGroup{}
-	wg.Add(2)
-	go startHTTPProxy(&wg, configManager, authClient, usageReporter)
-	go startSOCKSProxy(&wg, configManager, authClient, usageReporter)
+	if *muxAddr != "" {
+		wg.Add(1)
+		go startMux(&wg, *muxAddr, *tlsCert, *tlsKey, httpHandler, socksServer)
+	}
+	if *httpAddr != "" {
+		wg.Add(1)
+		go startHTTPProxy(&wg, *httpAddr, httpHandler)
+	}
+	if *socksAddr != "" {
+		wg.Add(1)
+		go startSOCKSProxy(&wg, *socksAddr, socksServer)
+	}
 	wg.Wait()
 }
 
-func startHTTPProxy(wg *sync.WaitGroup, configManager *config.ConfigManager, authClient *auth.AuthClient, usageReporter *usage.UsageRepoter) {
-	addr := ":8081"
+func startStatusServer(configManager *config.ConfigManager, authClient *auth.AuthClient, workerStats *stats.Stats, upstreamBalancer *balancer.Balancer, upstreamHealth *health.Checker, socksServer *proxy.ConnServer) {
+	addr := ":8082"
 
-	p := proxy.NewHTTPProxy(configManager, authClient, usageReporter)
+	mux := http.NewServeMux()
+	mux.HandleFunc("/status", func(w http.ResponseWriter, r *http.Request) {
+		configStatus := configManager.Status()
+		authStatus := authClient.Status()
 
-	go configManager.StartSync(30 * time.Second)
+		mode := "normal"
+		if configStatus.Degraded || authStatus.Degraded {
+			mode = "degraded"
+		}
 
-	srv := &http.Server{
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(struct {
+			Mode             string                  `json:"mode"`
+			Version          string                  `json:"version"`
+			Config           config.Status           `json:"config"`
+			Auth             auth.Status             `json:"auth"`
+			Stats            stats.Snapshot          `json:"stats"`
+			Upstreams        []models.UpstreamHealth `json:"upstreams"`
+			Loads            []balancer.Load         `json:"loads"`
+			SocksConnections int                     `json:"socks_connections"`
+		}{Mode: mode, Version: version, Config: configStatus, Auth: authStatus, Stats: workerStats.Snapshot(), Upstreams: upstreamHealth.Snapshot(), Loads: upstreamBalancer.Loads(), SocksConnections: socksServer.ActiveConnections()})
+	})
+
+	log.Printf("Status server listening on %s", addr)
+	if err := http.ListenAndServe(addr, mux); err != nil {
+		log.Printf("Status server stopped: %v", err)
+	}
+}
+
+func newProxyServer(addr string, handler http.Handler) *http.Server {
+	return &http.Server{
 		Addr:         addr,
-		Handler:      http.HandlerFunc(p.HandleConnection),
+		Handler:      handler,
 		ReadTimeout:  15 * time.Second,
 		WriteTimeout: 15 * time.Second,
 		IdleTimeout:  60 * time.Second,
 	}
+}
+
+func startHTTPProxy(wg *sync.WaitGroup, addr string, handler http.Handler) {
+	defer wg.Done()
+
+	srv := newProxyServer(addr, handler)
 	log.Printf("HTTP/S proxy listening on %s", addr)
 	if err := srv.ListenAndServe(); err != nil {
-		wg.Done()
-		return
+		log.Printf("HTTP/S proxy stopped: %v", err)
 	}
 }
 
-func startSOCKSProxy(wg *sync.WaitGroup, configManager *config.ConfigManager, authClient *auth.AuthClient, usageReporter *usage.UsageRepoter) {
-	addr := ":1080"
-	s := proxy.NewSocksProxy(configManager, authClient, usageReporter)
+func startSOCKSProxy(wg *sync.WaitGroup, addr string, socksServer *proxy.ConnServer) {
 	listner, err := net.Listen("tcp", addr)
 	if err != nil {
-		log.Fatalf("failed to listen :1080: %s", err)
+		log.Fatalf("failed to listen %s: %s", addr, err)
+	}
+	defer wg.Done()
+	log.Printf("SOCKS5 proxy listening on %s", addr)
+
+	if err := socksServer.Serve(listner); err != proxy.ErrServerClosed {
+		log.Printf("SOCKS5 proxy stopped: %v", err)
+	}
+}
+
+// startMux serves HTTP, SOCKS and, when a certificate is configured, TLS
+// proxy clients on one port. It is the worker's main listener; the
+// dedicated HTTP and SOCKS ports are only opened when asked for.
+func startMux(wg *sync.WaitGroup, addr, certFile, keyFile string, handler http.Handler, socksServer *proxy.ConnServer) {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		log.Fatalf("failed to listen %s: %s", addr, err)
 	}
-	defer listner.Close()
 	defer wg.Done()
-	log.Println("SOCKS5 proxy listening on :1080")
+	mux := proxy.NewMux(l, 10*time.Second)
 
-	for {
-		conn, err := listner.Accept()
+	if certFile != "" && keyFile != "" {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
 		if err != nil {
-			log.Printf("Failed to accept connection: %s", err)
-			continue
+			log.Fatalf("failed to load TLS certificate: %s", err)
 		}
-		s.HandleConnection(conn)
+		tlsListener := tls.NewListener(mux.TLS(), &tls.Config{Certificates: []tls.Certificate{cert}})
+		go newProxyServer(addr, handler).Serve(tlsListener)
+	}
+
+	go newProxyServer(addr, handler).Serve(mux.HTTP())
+	go socksServer.Serve(mux.SOCKS())
+
+	log.Printf("Mux proxy listening on %s", addr)
+	if err := mux.Serve(); err != nil {
+		log.Printf("Mux proxy stopped: %v", err)
+	}
+}
+
+// drainOnSignal stops the SOCKS listener on SIGINT or SIGTERM and gives
+// open connections a grace period to finish before exiting.
+func drainOnSignal(socksServer *proxy.ConnServer, store *cache.Store) {
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, syscall.SIGINT, syscall.SIGTERM)
+	<-sigCh
+
+	log.Printf("Shutting down, draining %d SOCKS connections", socksServer.ActiveConnections())
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	if err := socksServer.Shutdown(ctx); err != nil {
+		log.Printf("Forced close of SOCKS connections: %v", err)
 	}
+	store.Flush()
+	os.Exit(0)
 }
@@ -0,0 +1,17 @@
+package models
+
+const (
+	EventPools = "pools"
+	EventUser  = "user"
+	EventPing  = "ping"
+	// EventKillSession asks workers to drop a user's sticky session.
+	EventKillSession = "kill_session"
+)
+
+type ConfigEvent struct {
+	Type       string `json:"type"`
+	Version    int64  `json:"version"`
+	UserID     string `json:"user_id,omitempty"`
+	Session    string `json:"session,omitempty"`
+	Generation int    `json:"generation,omitempty"`
+}
@@ -0,0 +1,56 @@
+package models
+
+import "time"
+
+type RegisterRequest struct {
+	Name       string         `json:"name"`
+	Version    string         `json:"version"`
+	PublicAddr string         `json:"public_addr"`
+	Ports      map[string]int `json:"ports"`
+}
+
+type HeartbeatRequest struct {
+	Name      string           `json:"name"`
+	Stats     WorkerStats      `json:"stats"`
+	Upstreams []UpstreamHealth `json:"upstreams,omitempty"`
+	Sessions  []ActiveSession  `json:"sessions,omitempty"`
+}
+
+type HeartbeatResponse struct {
+	Message        string          `json:"message"`
+	KilledSessions []KilledSession `json:"killed_sessions,omitempty"`
+}
+
+// KilledSession is a session generation as captain keeps it.
+type KilledSession struct {
+	UserID     string    `json:"user_id"`
+	Session    string    `json:"session"`
+	Generation int       `json:"generation"`
+	ExpiresAt  time.Time `json:"expires_at"`
+}
+
+type WorkerStats struct {
+	ActiveConnections int64   `json:"active_connections"`
+	BytesInPerSec     float64 `json:"bytes_in_per_sec"`
+	BytesOutPerSec    float64 `json:"bytes_out_per_sec"`
+	StickySessions    int64   `json:"sticky_sessions"`
+}
+
+type UpstreamHealth struct {
+	Upstream  string    `json:"upstream"`
+	State     string    `json:"state"`
+	Failures  int       `json:"failures"`
+	CheckedAt time.Time `json:"checked_at,omitzero"`
+	LastError string    `json:"last_error,omitempty"`
+}
+
+type ActiveSession struct {
+	UserID      string    `json:"user_id"`
+	Session     string    `json:"session"`
+	Upstream    string    `json:"upstream"`
+	Country     string    `json:"country,omitempty"`
+	CreatedAt   time.Time `json:"created_at"`
+	ExpiresAt   time.Time `json:"expires_at"`
+	Bytes       int64     `json:"bytes"`
+	Connections int       `json:"connections"`
+}
@@ -0,0 +1,44 @@
+package proxy
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/pubudu2003060/go-proxy-prototype/filters"
+)
+
+var errInvalidFilters = errors.New("invalid filters")
+
+// splitCredentials splits "username:password-filters" into its parts. HTTP
+// Basic credentials and SOCKS4 USERIDs use this form.
+func splitCredentials(userPass string) (string, string, filters.Filters, error) {
+	username, rest, ok := strings.Cut(userPass, ":")
+	if !ok {
+		return "", "", filters.Filters{}, errors.New("credentials missing ':'")
+	}
+	if username == "" {
+		return "", "", filters.Filters{}, errors.New("credentials missing username")
+	}
+
+	password, f, err := splitFilters(rest)
+	if err != nil {
+		return "", "", filters.Filters{}, err
+	}
+	return username, password, f, nil
+}
+
+// splitFilters splits filters such as "-country-jp_session-xxx" off a
+// password and parses them. A password without filters is returned whole.
+func splitFilters(password string) (string, filters.Filters, error) {
+	i := strings.IndexByte(password, '-')
+	if i < 0 {
+		return password, filters.Filters{}, nil
+	}
+
+	f, err := filters.Parse(password[i:])
+	if err != nil {
+		return "", filters.Filters{}, fmt.Errorf("%w: %w", errInvalidFilters, err)
+	}
+	return password[:i], f, nil
+}
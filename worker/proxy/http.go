@@ -1,6 +1,7 @@
 package proxy
 
 import (
+	"context"
 	"encoding/base64"
 	"errors"
 	"fmt"
@@ -8,38 +9,58 @@ import (
 	"log"
 	"net"
 	"net/http"
+	"net/http/httptrace"
 	"net/url"
-	"strconv"
 	"strings"
-	"sync"
+	"sync/atomic"
+	"time"
 
+	"github.com/pubudu2003060/go-proxy-prototype/filters"
 	"github.com/pubudu2003060/go-proxy-prototype/worker/auth"
+	"github.com/pubudu2003060/go-proxy-prototype/worker/balancer"
 	"github.com/pubudu2003060/go-proxy-prototype/worker/config"
+	"github.com/pubudu2003060/go-proxy-prototype/worker/health"
 	"github.com/pubudu2003060/go-proxy-prototype/worker/models"
+	"github.com/pubudu2003060/go-proxy-prototype/worker/session"
+	"github.com/pubudu2003060/go-proxy-prototype/worker/stats"
 	"github.com/pubudu2003060/go-proxy-prototype/worker/usage"
 )
 
 type HTTPProxy struct {
+	// Retry controls failover to the pool's other outs when an upstream
+	// cannot be reached.
+	Retry RetryPolicy
+
 	ConfigManager *config.ConfigManager
 	authClient    *auth.AuthClient
 	usageRepoter  *usage.UsageRepoter
-	sessionMap    map[string]string
-	mu            sync.RWMutex
+	stats         *stats.Stats
+	sessionMap    *sessionTable
 }
 
-func NewHTTPProxy(configManager *config.ConfigManager, authClient *auth.AuthClient, usageRepoter *usage.UsageRepoter) *HTTPProxy {
+func NewHTTPProxy(configManager *config.ConfigManager, authClient *auth.AuthClient, usageRepoter *usage.UsageRepoter, stats *stats.Stats, balancer *balancer.Balancer, health *health.Checker, sessions *session.Store) *HTTPProxy {
 	return &HTTPProxy{
+		Retry:         DefaultRetryPolicy,
 		ConfigManager: configManager,
 		authClient:    authClient,
 		usageRepoter:  usageRepoter,
-		sessionMap:    make(map[string]string),
+		stats:         stats,
+		sessionMap:    newSessionTable(balancer, health, sessions),
 	}
 }
 
 func (p *HTTPProxy) HandleConnection(w http.ResponseWriter, r *http.Request) {
+	p.stats.ConnOpened()
+	defer p.stats.ConnClosed()
+
 	log.Printf("new request come:%v", r.Host)
 	proxyAuth := r.Header.Get("Proxy-Authorization")
-	authresp, filters, err := p.authenticateProxyHeader(proxyAuth)
+	authresp, userFilters, err := p.authenticateProxyHeader(proxyAuth)
+	if errors.Is(err, errInvalidFilters) {
+		log.Printf("auth failed: %v", err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
 	if err != nil {
 		log.Printf("auth failed: %v", err)
 		p.send407(w)
@@ -51,25 +72,14 @@ func (p *HTTPProxy) HandleConnection(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	pools := p.ConfigManager.GetPools()
-
-	var selectedPool *models.Pool
-	for _, poolName := range authresp.AllowedPools {
-		name := strings.TrimSpace(poolName)
-		name = strings.ToLower(name)
-		if pool, exit := pools[name]; exit {
-			selectedPool = pool
-			break
-		}
-	}
-
+	selectedPool := selectPool(authresp.AllowedPools, p.ConfigManager.GetPools(), userFilters.Pool)
 	if selectedPool == nil {
 		log.Println("there is no allowd pools.directly connect to destination")
 		p.send500(w)
 		return
 	}
 
-	upstream := p.selectUpstream(selectedPool, filters)
+	upstream := p.sessionMap.selectUpstream(selectedPool, authresp.UserID, userFilters)
 	if upstream == nil {
 		log.Println("there is no allowd upstreams.directly connect to destination")
 		p.send500(w)
@@ -78,53 +88,73 @@ func (p *HTTPProxy) HandleConnection(w http.ResponseWriter, r *http.Request) {
 
 	r.Header.Del("Proxy-Authorization")
 
-	i := strings.Index(upstream.Format, "-")
-	credentials := upstream.Format[:i] + filters
-
-	upStreamURL := "http://" + credentials + "@" + upstream.Domain + ":" + strconv.Itoa(upstream.UpstreamPort)
-
-	u, err := url.Parse(upStreamURL)
-	if err != nil {
-		log.Fatal("Invalid upstream proxy: ", err)
-		p.send500(w)
-		return
-	}
-
 	if r.Method == http.MethodConnect {
-		p.handleConnect(w, r, u)
+		p.handleConnect(w, r, selectedPool, upstream, userFilters, authresp.UserID)
 		return
 	}
-	p.handleHTTP(w, r, u)
+	p.handleHTTP(w, r, selectedPool, upstream, userFilters, authresp.UserID)
 }
 
-func (p *HTTPProxy) handleHTTP(w http.ResponseWriter, r *http.Request, u *url.URL) {
+func (p *HTTPProxy) handleHTTP(w http.ResponseWriter, r *http.Request, pool *models.Pool, upstream *models.Out, f filters.Filters, userID string) {
 	log.Println("HTTP request:", r.URL.String())
 
-	var transport *http.Transport
+	// The transport may still be writing the body while the response is
+	// read, so the request side is counted atomically.
+	var sent atomic.Int64
+	var body io.Reader
+	if r.ContentLength != 0 {
+		body = &countingReader{r: r.Body, add: func(n int64) {
+			sent.Add(n)
+			p.stats.AddIn(n)
+		}}
+	}
 
-	if u == nil {
-		transport = &http.Transport{}
-	} else {
-		transport = &http.Transport{
-			Proxy: http.ProxyURL(u),
+	var resp *http.Response
+	var cancelResp context.CancelFunc
+	release, err := p.sessionMap.failover(pool, upstream, userID, f, p.Retry, p.stats, func(u *url.URL, deadline time.Time) (bool, error) {
+		transport := &http.Transport{
+			Proxy:       http.ProxyURL(u),
+			DialContext: (&net.Dialer{Timeout: time.Until(deadline)}).DialContext,
 		}
-	}
+		client := &http.Client{Transport: transport}
 
-	client := &http.Client{Transport: transport}
+		// Until the request headers are written nothing of the client's
+		// request has left the worker and another upstream can be tried.
+		var wrote atomic.Bool
+		trace := &httptrace.ClientTrace{WroteHeaders: func() { wrote.Store(true) }}
 
-	req, err := http.NewRequest(r.Method, r.URL.String(), r.Body)
-	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
-	}
+		// The deadline holds until the response headers arrive; the body
+		// takes as long as it takes.
+		ctx, cancel := context.WithCancel(r.Context())
+		timer := time.AfterFunc(time.Until(deadline), cancel)
 
-	req.Header = r.Header.Clone()
+		req, err := http.NewRequestWithContext(httptrace.WithClientTrace(ctx, trace), r.Method, r.URL.String(), body)
+		if err != nil {
+			timer.Stop()
+			cancel()
+			return false, err
+		}
+		req.ContentLength = r.ContentLength
 
-	resp, err := client.Do(req)
+		req.Header = r.Header.Clone()
+
+		resp, err = client.Do(req)
+		if !timer.Stop() && err != nil && r.Context().Err() == nil {
+			err = fmt.Errorf("no response from upstream %s within the attempt timeout", u.Host)
+		}
+		if err != nil {
+			cancel()
+			return !wrote.Load(), err
+		}
+		cancelResp = cancel
+		return false, nil
+	})
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusBadGateway)
 		return
 	}
+	defer release()
+	defer cancelResp()
 	defer resp.Body.Close()
 
 	for k, v := range resp.Header {
@@ -133,121 +163,61 @@ func (p *HTTPProxy) handleHTTP(w http.ResponseWriter, r *http.Request, u *url.UR
 		}
 	}
 	w.WriteHeader(resp.StatusCode)
-	io.Copy(w, resp.Body)
+	add, done := p.sessionMap.track(userID, f, resp.Body)
+	add(sent.Load())
+	received, _ := io.Copy(&countingWriter{w: w, add: func(n int64) {
+		p.stats.AddOut(n)
+		add(n)
+	}}, resp.Body)
+	done()
+	p.usageRepoter.ReportUsage(userID, sent.Load()+received)
 }
 
-func (p *HTTPProxy) handleConnect(w http.ResponseWriter, r *http.Request, u *url.URL) {
+func (p *HTTPProxy) handleConnect(w http.ResponseWriter, r *http.Request, pool *models.Pool, upstream *models.Out, f filters.Filters, userID string) {
 	log.Println("HTTPS request:", r.Host)
 
-	if u == nil {
-		destConn, err := net.Dial("tcp", r.Host)
-		if err != nil {
-			http.Error(w, "Cannot connect to target", http.StatusBadGateway)
-			return
-		}
-
-		hj, ok := w.(http.Hijacker)
-		if !ok {
-			http.Error(w, "Hijacking not supported", http.StatusInternalServerError)
-			return
-		}
-		clientConn, _, err := hj.Hijack()
-		if err != nil {
-			http.Error(w, "Hijack failed", http.StatusInternalServerError)
-			return
-		}
-
-		clientConn.Write([]byte("HTTP/1.1 200 Connection Established\r\n\r\n"))
-
-		go io.Copy(destConn, clientConn)
-		go io.Copy(clientConn, destConn)
-		return
-	}
-
-	upstreamConn, err := net.Dial("tcp", u.Host)
+	var destConn net.Conn
+	release, err := p.sessionMap.failover(pool, upstream, userID, f, p.Retry, p.stats, func(u *url.URL, deadline time.Time) (bool, error) {
+		conn, _, err := dialUpstream(u, r.Host, deadline)
+		destConn = conn
+		return true, err
+	})
 	if err != nil {
+		log.Printf("Failed to connect to %s: %v", r.Host, err)
 		http.Error(w, "Cannot reach upstream", http.StatusBadGateway)
 		return
 	}
-
-	connectReq := "CONNECT " + r.Host + " HTTP/1.1\r\n"
-	if u.User != nil {
-		user := u.User.String()
-		auth := "Proxy-Authorization: Basic " + base64.StdEncoding.EncodeToString([]byte(user)) + "\r\n"
-		connectReq += auth
-	}
-	connectReq += "\r\n"
-
-	_, err = upstreamConn.Write([]byte(connectReq))
-	if err != nil {
-		http.Error(w, "Failed to send CONNECT", http.StatusBadGateway)
-		return
-	}
-
-	buf := make([]byte, 4096)
-	n, _ := upstreamConn.Read(buf)
-	log.Printf("Upstream replied: %s", string(buf[:n]))
+	defer release()
 
 	hj, ok := w.(http.Hijacker)
 	if !ok {
+		destConn.Close()
 		http.Error(w, "Hijacking not supported", http.StatusInternalServerError)
 		return
 	}
 	clientConn, _, err := hj.Hijack()
 	if err != nil {
+		destConn.Close()
 		http.Error(w, "Hijack failed", http.StatusInternalServerError)
 		return
 	}
 
+	clientConn.SetDeadline(time.Time{})
 	clientConn.Write([]byte("HTTP/1.1 200 Connection Established\r\n\r\n"))
 
-	go io.Copy(upstreamConn, clientConn)
-	go io.Copy(clientConn, upstreamConn)
+	add, done := p.sessionMap.track(userID, f, destConn)
+	sent, received := tunnel(p.stats, clientConn, destConn, add)
+	done()
+	p.usageRepoter.ReportUsage(userID, sent+received)
 }
 
-func (p *HTTPProxy) selectUpstream(pool *models.Pool, filters string) *models.Out {
-	var sessionID string
-
-	if strings.Contains(filters, "session") {
-		i := strings.Index(filters, "session")
-		sessionID = filters[i+8 : i+15]
-	} else if strings.Contains(filters, "sid") {
-		i := strings.Index(filters, "sid")
-		sessionID = filters[i+4 : i+12]
-	}
-
-	p.mu.RLock()
-	upstreamKey, exists := p.sessionMap[sessionID]
-	p.mu.RUnlock()
-
-	if len(pool.Outs) == 0 {
-		return nil
-	}
-
-	if exists {
-		for _, out := range pool.Outs {
-			if out.Domain == upstreamKey {
-				return &out
-			}
-		}
-	}
-
-	selected := &pool.Outs[0]
-
-	p.mu.Lock()
-	p.sessionMap[sessionID] = selected.Domain
-	p.mu.Unlock()
-
-	return selected
-}
-
-func (p *HTTPProxy) authenticateProxyHeader(header string) (*models.AuthResponse, string, error) {
+func (p *HTTPProxy) authenticateProxyHeader(header string) (*models.AuthResponse, filters.Filters, error) {
 	if header == "" {
-		return nil, "", errors.New("missing proxy-authorization")
+		return nil, filters.Filters{}, errors.New("missing proxy-authorization")
 	}
 	parts := strings.SplitN(header, " ", 2)
 	if len(parts) != 2 {
-		return nil, "", errors.New("malformed proxy-authorization")
+		return nil, filters.Filters{}, errors.New("malformed proxy-authorization")
 	}
 	scheme := strings.ToLower(parts[0])
 	cred := strings.TrimSpace(parts[1])
@@ -256,23 +226,20 @@ func (p *HTTPProxy) authenticateProxyHeader(header string) (*models.AuthResponse
 	case "basic":
 		decoded, err := base64.StdEncoding.DecodeString(cred)
 		if err != nil {
-			return nil, "", fmt.Errorf("bad basic encoding: %w", err)
+			return nil, filters.Filters{}, fmt.Errorf("bad basic encoding: %w", err)
 		}
-		up := string(decoded)
-		position := strings.IndexByte(up, ':')
-		filterPosition := strings.IndexByte(up, '-')
-		if position < 0 {
-			return nil, "", errors.New("basic credentials missing ':'")
+		username, password, userFilters, err := splitCredentials(string(decoded))
+		if err != nil {
+			return nil, filters.Filters{}, fmt.Errorf("bad basic credentials: %w", err)
 		}
-		username, password, cred := up[:position], up[position+1:filterPosition], up[filterPosition:]
 		authresp, err := p.authClient.Authenticate(username, password)
 		if err != nil {
 			log.Println("Error authenticate", err)
-			return nil, "", errors.New("invalid user/pass")
+			return nil, filters.Filters{}, errors.New("invalid user/pass")
 		}
-		return authresp, cred, nil
+		return authresp, userFilters, nil
 	default:
-		return nil, "", fmt.Errorf("unsupported auth scheme: %s", scheme)
+		return nil, filters.Filters{}, fmt.Errorf("unsupported auth scheme: %s", scheme)
 	}
 }
 
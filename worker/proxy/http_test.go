@@ -0,0 +1,70 @@
+package proxy
+
+import (
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/pubudu2003060/go-proxy-prototype/filters"
+	"github.com/pubudu2003060/go-proxy-prototype/worker/balancer"
+	"github.com/pubudu2003060/go-proxy-prototype/worker/health"
+	"github.com/pubudu2003060/go-proxy-prototype/worker/models"
+	"github.com/pubudu2003060/go-proxy-prototype/worker/session"
+	"github.com/pubudu2003060/go-proxy-prototype/worker/stats"
+)
+
+func TestHandleHTTPUpstreamHangs(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	// The upstream takes the request and never answers.
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go io.Copy(io.Discard, conn)
+		}
+	}()
+
+	st := stats.New()
+	p := &HTTPProxy{
+		Retry:      RetryPolicy{MaxAttempts: 1, AttemptTimeout: 200 * time.Millisecond, TotalTimeout: time.Second},
+		stats:      st,
+		sessionMap: newSessionTable(balancer.New(), health.NewChecker(nil, nil), session.NewStore(st)),
+	}
+	pool := &models.Pool{
+		Name: "test",
+		Outs: []models.Out{{
+			Domain:       "127.0.0.1",
+			UpstreamPort: ln.Addr().(*net.TCPAddr).Port,
+			Username:     "acct",
+			Password:     "secret",
+		}},
+	}
+
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest(http.MethodGet, "http://example.com/", nil)
+
+	done := make(chan struct{})
+	go func() {
+		p.handleHTTP(w, r, pool, &pool.Outs[0], filters.Filters{}, "user")
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("handleHTTP still waiting on a hung upstream after 5s")
+	}
+	if w.Code != http.StatusBadGateway {
+		t.Errorf("status %d, want %d", w.Code, http.StatusBadGateway)
+	}
+}
@@ -0,0 +1,153 @@
+package proxy
+
+import (
+	"bufio"
+	"log"
+	"net"
+	"sync"
+	"time"
+)
+
+// Mux serves HTTP, SOCKS and TLS proxy clients on a single listener. It
+// peeks at the first byte of every connection and hands the connection to
+// the matching virtual listener: 0x04 and 0x05 go to SOCKS, a TLS
+// ClientHello (0x16) to TLS and an ASCII method letter to HTTP.
+type Mux struct {
+	listener    net.Listener
+	peekTimeout time.Duration
+	socks       *chanListener
+	http        *chanListener
+	tls         *chanListener
+}
+
+func NewMux(l net.Listener, peekTimeout time.Duration) *Mux {
+	return &Mux{
+		listener:    l,
+		peekTimeout: peekTimeout,
+		socks:       newChanListener(l.Addr()),
+		http:        newChanListener(l.Addr()),
+	}
+}
+
+func (m *Mux) SOCKS() net.Listener {
+	return m.socks
+}
+
+func (m *Mux) HTTP() net.Listener {
+	return m.http
+}
+
+// TLS returns the listener for TLS clients. Without a call to TLS before
+// Serve, TLS clients are refused.
+func (m *Mux) TLS() net.Listener {
+	if m.tls == nil {
+		m.tls = newChanListener(m.listener.Addr())
+	}
+	return m.tls
+}
+
+// Serve accepts connections until the underlying listener is closed, then
+// closes the virtual listeners.
+func (m *Mux) Serve() error {
+	defer func() {
+		m.socks.Close()
+		m.http.Close()
+		if m.tls != nil {
+			m.tls.Close()
+		}
+	}()
+
+	var backoff time.Duration
+	for {
+		conn, err := m.listener.Accept()
+		if err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Timeout() {
+				backoff = min(max(2*backoff, 5*time.Millisecond), time.Second)
+				time.Sleep(backoff)
+				continue
+			}
+			return err
+		}
+		backoff = 0
+
+		go m.dispatch(conn)
+	}
+}
+
+func (m *Mux) Close() error {
+	return m.listener.Close()
+}
+
+func (m *Mux) dispatch(conn net.Conn) {
+	conn.SetReadDeadline(time.Now().Add(m.peekTimeout))
+	br := bufio.NewReader(conn)
+	first, err := br.Peek(1)
+	if err != nil {
+		conn.Close()
+		return
+	}
+	conn.SetReadDeadline(time.Time{})
+
+	var target *chanListener
+	switch b := first[0]; {
+	case b == SOCKS4_VERSION || b == PROXY_VERSION:
+		target = m.socks
+	case b == 0x16: // TLS handshake record
+		target = m.tls
+	case b >= 'A' && b <= 'Z':
+		target = m.http
+	}
+
+	if target == nil {
+		log.Printf("Unrecognised protocol from %s (first byte 0x%02x)", conn.RemoteAddr(), first[0])
+		conn.Close()
+		return
+	}
+
+	if !target.deliver(&bufferedConn{Conn: conn, r: br}) {
+		conn.Close()
+	}
+}
+
+// chanListener is a net.Listener fed by Mux.
+type chanListener struct {
+	addr   net.Addr
+	conns  chan net.Conn
+	done   chan struct{}
+	closed sync.Once
+}
+
+func newChanListener(addr net.Addr) *chanListener {
+	return &chanListener{
+		addr:  addr,
+		conns: make(chan net.Conn),
+		done:  make(chan struct{}),
+	}
+}
+
+func (l *chanListener) deliver(conn net.Conn) bool {
+	select {
+	case l.conns <- conn:
+		return true
+	case <-l.done:
+		return false
+	}
+}
+
+func (l *chanListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case <-l.done:
+		return nil, net.ErrClosed
+	}
+}
+
+func (l *chanListener) Close() error {
+	l.closed.Do(func() { close(l.done) })
+	return nil
+}
+
+func (l *chanListener) Addr() net.Addr {
+	return l.addr
+}
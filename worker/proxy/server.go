@@ -0,0 +1,167 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net"
+	"sync"
+	"time"
+)
+
+// ConnHandler serves a single client connection until it is done.
+type ConnHandler interface {
+	HandleConnection(conn net.Conn)
+}
+
+// ConnServer accepts connections and serves each in its own goroutine,
+// bounded by MaxConns. Active connections are tracked so they can be
+// counted and drained on shutdown.
+type ConnServer struct {
+	handler   ConnHandler
+	maxConns  int
+	slots     chan struct{}
+	conns     map[net.Conn]struct{}
+	wg        sync.WaitGroup
+	closed    bool
+	listeners map[net.Listener]struct{}
+	mu        sync.Mutex
+}
+
+func NewConnServer(handler ConnHandler, maxConns int) *ConnServer {
+	return &ConnServer{
+		handler:   handler,
+		maxConns:  maxConns,
+		slots:     make(chan struct{}, maxConns),
+		conns:     make(map[net.Conn]struct{}),
+		listeners: make(map[net.Listener]struct{}),
+	}
+}
+
+var ErrServerClosed = errors.New("proxy: server closed")
+
+// Serve accepts connections on l until Shutdown is called. Temporary
+// accept errors are retried with exponential backoff. Serve may be called
+// for several listeners; they share the connection limit.
+func (s *ConnServer) Serve(l net.Listener) error {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return ErrServerClosed
+	}
+	s.listeners[l] = struct{}{}
+	s.mu.Unlock()
+
+	var backoff time.Duration
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			if s.isClosed() {
+				return ErrServerClosed
+			}
+			if errors.Is(err, net.ErrClosed) {
+				s.mu.Lock()
+				delete(s.listeners, l)
+				s.mu.Unlock()
+				return err
+			}
+			if backoff == 0 {
+				backoff = 5 * time.Millisecond
+			} else {
+				backoff *= 2
+			}
+			if backoff > time.Second {
+				backoff = time.Second
+			}
+			log.Printf("Failed to accept connection: %s; retrying in %v", err, backoff)
+			time.Sleep(backoff)
+			continue
+		}
+		backoff = 0
+
+		select {
+		case s.slots <- struct{}{}:
+		default:
+			log.Printf("Connection limit of %d reached, rejecting %s", s.maxConns, conn.RemoteAddr())
+			conn.Close()
+			continue
+		}
+
+		if !s.track(conn) {
+			<-s.slots
+			conn.Close()
+			return ErrServerClosed
+		}
+
+		go func() {
+			defer func() {
+				s.untrack(conn)
+				<-s.slots
+			}()
+			s.handler.HandleConnection(conn)
+		}()
+	}
+}
+
+func (s *ConnServer) track(conn net.Conn) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.closed {
+		return false
+	}
+	s.conns[conn] = struct{}{}
+	s.wg.Add(1)
+	return true
+}
+
+func (s *ConnServer) untrack(conn net.Conn) {
+	s.mu.Lock()
+	delete(s.conns, conn)
+	s.mu.Unlock()
+	s.wg.Done()
+}
+
+func (s *ConnServer) isClosed() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.closed
+}
+
+func (s *ConnServer) ActiveConnections() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return len(s.conns)
+}
+
+// Shutdown stops accepting connections and waits for active ones to
+// finish. When ctx expires first the remaining connections are closed.
+func (s *ConnServer) Shutdown(ctx context.Context) error {
+	s.mu.Lock()
+	s.closed = true
+	for l := range s.listeners {
+		l.Close()
+	}
+	s.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		s.wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		s.mu.Lock()
+		for conn := range s.conns {
+			conn.Close()
+		}
+		s.mu.Unlock()
+		<-done
+		return ctx.Err()
+	}
+}
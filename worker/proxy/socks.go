@@ -1,92 +1,232 @@
 package proxy
 
 import (
+	"bufio"
 	"encoding/binary"
+	"errors"
 	"fmt"
 	"io"
 	"log"
 	"net"
+	"net/http"
+	"net/url"
 	"strconv"
 	"sync"
+	"syscall"
+	"time"
 
+	"github.com/pubudu2003060/go-proxy-prototype/filters"
 	"github.com/pubudu2003060/go-proxy-prototype/worker/auth"
+	"github.com/pubudu2003060/go-proxy-prototype/worker/balancer"
 	"github.com/pubudu2003060/go-proxy-prototype/worker/config"
+	"github.com/pubudu2003060/go-proxy-prototype/worker/health"
+	"github.com/pubudu2003060/go-proxy-prototype/worker/models"
+	"github.com/pubudu2003060/go-proxy-prototype/worker/session"
+	"github.com/pubudu2003060/go-proxy-prototype/worker/stats"
 	"github.com/pubudu2003060/go-proxy-prototype/worker/usage"
 )
 
 var PROXY_VERSION = byte(0x05)
 var Uandp = byte(0x02)
 
-const CMD_CONNECT = byte(0x01)
+const (
+	CMD_CONNECT       = byte(0x01)
+	CMD_BIND          = byte(0x02)
+	CMD_UDP_ASSOCIATE = byte(0x03)
+)
+
+// RFC 1928 reply codes.
+const (
+	REP_SUCCEEDED             = byte(0x00)
+	REP_GENERAL_FAILURE       = byte(0x01)
+	REP_NOT_ALLOWED           = byte(0x02)
+	REP_NETWORK_UNREACHABLE   = byte(0x03)
+	REP_HOST_UNREACHABLE      = byte(0x04)
+	REP_CONNECTION_REFUSED    = byte(0x05)
+	REP_TTL_EXPIRED           = byte(0x06)
+	REP_COMMAND_NOT_SUPPORTED = byte(0x07)
+	REP_ADDRESS_NOT_SUPPORTED = byte(0x08)
+)
+
+var errAddressType = errors.New("unsupported address type")
 
 type SocksProxy struct {
+	// HandshakeTimeout bounds the time a client may take to authenticate
+	// and send its request.
+	HandshakeTimeout time.Duration
+	// BindTimeout bounds the wait for the inbound connection of a BIND.
+	BindTimeout time.Duration
+	// MaxBindsPerUser caps the listening sockets a user may hold open.
+	MaxBindsPerUser int
+	// Retry controls failover to the pool's other outs when an upstream
+	// cannot be reached.
+	Retry RetryPolicy
+	// PublicAddr is the host BIND and UDP ASSOCIATE replies tell clients
+	// to reach. The address the client reached us on is used when empty.
+	PublicAddr string
+
 	ConfigManager *config.ConfigManager
 	authClient    *auth.AuthClient
 	usageRepoter  *usage.UsageRepoter
-	sessionMap    map[string]string
-	mu            sync.RWMutex
+	stats         *stats.Stats
+	sessionMap    *sessionTable
+	binds         map[string]int
+	bindMu        sync.Mutex
 }
 
-func NewSocksProxy(configManager *config.ConfigManager, authClient *auth.AuthClient, usageRepoter *usage.UsageRepoter) *SocksProxy {
+func NewSocksProxy(configManager *config.ConfigManager, authClient *auth.AuthClient, usageRepoter *usage.UsageRepoter, stats *stats.Stats, balancer *balancer.Balancer, health *health.Checker, sessions *session.Store) *SocksProxy {
 	return &SocksProxy{
-		ConfigManager: configManager,
-		authClient:    authClient,
-		usageRepoter:  usageRepoter,
-		sessionMap:    make(map[string]string),
+		HandshakeTimeout: 10 * time.Second,
+		BindTimeout:      2 * time.Minute,
+		MaxBindsPerUser:  4,
+		Retry:            DefaultRetryPolicy,
+		ConfigManager:    configManager,
+		authClient:       authClient,
+		usageRepoter:     usageRepoter,
+		stats:            stats,
+		sessionMap:       newSessionTable(balancer, health, sessions),
+		binds:            make(map[string]int),
 	}
 }
 
 func (s *SocksProxy) HandleConnection(client net.Conn) {
 	defer client.Close()
+	s.stats.ConnOpened()
+	defer s.stats.ConnClosed()
+
+	client.SetDeadline(time.Now().Add(s.HandshakeTimeout))
+
+	br := bufio.NewReader(client)
+	version, err := br.Peek(1)
+	if err != nil {
+		log.Printf("Failed to read SOCKS version: %s", err)
+		return
+	}
+	if version[0] == SOCKS4_VERSION {
+		s.handleSocks4(&bufferedConn{Conn: client, r: br}, br)
+		return
+	}
+	client = &bufferedConn{Conn: client, r: br}
 
 	//authentication
-	if err := s.authHandShake(client); err != nil {
+	authresp, userFilters, err := s.authHandShake(client)
+	if err != nil {
 		log.Printf("Authentication failed: %s", err)
 		return
 	}
 
 	//socks5 request
-	destAddr, err := requestHandShake(client)
+	cmd, destAddr, err := requestHandShake(client)
 	if err != nil {
 		log.Printf("Request handshake failed: %s", err)
+		if errors.Is(err, errAddressType) {
+			sendReply(client, REP_ADDRESS_NOT_SUPPORTED, nil)
+		}
+		return
+	}
+	client.SetDeadline(time.Time{})
+
+	if cmd != CMD_CONNECT && cmd != CMD_BIND && cmd != CMD_UDP_ASSOCIATE {
+		log.Printf("Unsupported command: %d", cmd)
+		sendReply(client, REP_COMMAND_NOT_SUPPORTED, nil)
+		return
+	}
+
+	if authresp.DataUsed >= authresp.DataLimit {
+		log.Printf("Data limit reached for user %s", authresp.UserID)
+		sendReply(client, REP_NOT_ALLOWED, nil)
+		return
+	}
+
+	// 3. Select the pool's upstream
+	selectedPool := selectPool(authresp.AllowedPools, s.ConfigManager.GetPools(), userFilters.Pool)
+	if selectedPool == nil {
+		log.Printf("No allowed pools for user %s", authresp.UserID)
+		sendReply(client, REP_NOT_ALLOWED, nil)
+		return
+	}
+
+	if cmd == CMD_BIND {
+		s.handleBind(client, authresp, destAddr)
 		return
 	}
 
-	// 3. Connect to the destination
-	dest, err := net.Dial("tcp", destAddr)
+	if cmd == CMD_UDP_ASSOCIATE {
+		upstream := s.sessionMap.selectUDPUpstream(selectedPool, authresp.UserID, userFilters)
+		if upstream == nil {
+			log.Printf("No upstream in pool %s supports UDP", selectedPool.Name)
+			sendReply(client, REP_COMMAND_NOT_SUPPORTED, nil)
+			return
+		}
+		u, err := s.sessionMap.upstreamURL(selectedPool, upstream, authresp.UserID, userFilters)
+		if err != nil {
+			log.Printf("Invalid upstream proxy: %v", err)
+			sendReply(client, REP_GENERAL_FAILURE, nil)
+			return
+		}
+		s.handleUDPAssociate(client, authresp, u, destAddr)
+		return
+	}
+
+	upstream := s.sessionMap.selectUpstream(selectedPool, authresp.UserID, userFilters)
+	if upstream == nil {
+		log.Printf("No upstreams in pool %s", selectedPool.Name)
+		sendReply(client, REP_GENERAL_FAILURE, nil)
+		return
+	}
+
+	// 4. Connect to the destination through the upstream
+	var dest net.Conn
+	var bound string
+	release, err := s.sessionMap.failover(selectedPool, upstream, authresp.UserID, userFilters, s.Retry, s.stats, func(u *url.URL, deadline time.Time) (bool, error) {
+		conn, addr, err := dialUpstream(u, destAddr, deadline)
+		dest, bound = conn, addr
+		return true, err
+	})
 	if err != nil {
 		log.Printf("Failed to connect to destination %s: %v", destAddr, err)
-		sendReply(client, 0x04, nil)
+		sendReply(client, replyCode(err), nil)
 		return
 	}
+	defer release()
 	defer dest.Close()
 
-	if err := sendReply(client, 0x00, dest.LocalAddr()); err != nil {
+	// BND is the address the exit connects from. Only SOCKS5 upstreams
+	// report it; otherwise the reply leaves it zero.
+	var bndAddr net.Addr
+	if bound != "" {
+		bndAddr = hostPort(bound)
+	}
+	if err := sendReply(client, REP_SUCCEEDED, bndAddr); err != nil {
 		log.Printf("Failed to send success reply: %v", err)
 		return
 	}
 
-	// 4. Tunnel the data
+	// 5. Tunnel the data
 	log.Printf("Tunneling data for %s", destAddr)
-	go io.Copy(dest, client)
-	io.Copy(client, dest)
+	add, done := s.sessionMap.track(authresp.UserID, userFilters, dest)
+	sent, received := tunnel(s.stats, client, dest, add)
+	done()
+	s.usageRepoter.ReportUsage(authresp.UserID, sent+received)
 	log.Printf("Connection closed for %s", destAddr)
 }
 
-func (s *SocksProxy) authHandShake(client io.ReadWriter) error {
+// authHandShake runs the username/password negotiation and returns the
+// user along with any filters appended to the password.
+func (s *SocksProxy) authHandShake(client io.ReadWriter) (*models.AuthResponse, filters.Filters, error) {
 	header := make([]byte, 2)
 	if _, err := io.ReadFull(client, header); err != nil {
-		return fmt.Errorf("failed to read header: %w", err)
+		return nil, filters.Filters{}, fmt.Errorf("failed to read header: %w", err)
 	}
 
 	if header[0] != PROXY_VERSION {
-		return fmt.Errorf("unsupported SOCKS5 version: %d", header[0])
+		return nil, filters.Filters{}, fmt.Errorf("unsupported SOCKS5 version: %d", header[0])
 	}
 
 	nMethods := int(header[1])
 	methods := make([]byte, nMethods)
 	if _, err := io.ReadFull(client, methods); err != nil {
-		return fmt.Errorf("failed to read methods: %w", err)
+		return nil, filters.Filters{}, fmt.Errorf("failed to read methods: %w", err)
 	}
 
 	hasAuth := false
@@ -98,61 +238,75 @@ func (s *SocksProxy) authHandShake(client io.ReadWriter) error {
 	}
 
 	if !hasAuth {
-		return fmt.Errorf("client is not suported username and pasword for socks5")
+		return nil, filters.Filters{}, fmt.Errorf("client is not suported username and pasword for socks5")
 	}
 
 	if _, err := client.Write([]byte{PROXY_VERSION, Uandp}); err != nil {
-		return err
+		return nil, filters.Filters{}, err
 	}
 
 	upHeader := make([]byte, 2)
 	if _, err := io.ReadFull(client, upHeader); err != nil {
-		return fmt.Errorf("failed to read auth header: %w", err)
+		return nil, filters.Filters{}, fmt.Errorf("failed to read auth header: %w", err)
 	}
 
 	ulen := upHeader[1]
 	uname := make([]byte, ulen)
 	if _, err := io.ReadFull(client, uname); err != nil {
-		return fmt.Errorf("failed to read username in socks5: %w", err)
+		return nil, filters.Filters{}, fmt.Errorf("failed to read username in socks5: %w", err)
 	}
 
 	plen := make([]byte, 1)
 	if _, err := io.ReadFull(client, plen); err != nil {
-		return fmt.Errorf("failed to read username in socks5: %w", err)
+		return nil, filters.Filters{}, fmt.Errorf("failed to read username in socks5: %w", err)
 	}
 
 	password := make([]byte, plen[0])
 	if _, err := io.ReadFull(client, password); err != nil {
-		return fmt.Errorf("failed to read username in socks5: %w", err)
+		return nil, filters.Filters{}, fmt.Errorf("failed to read username in socks5: %w", err)
 	}
 
-	_, err := s.authClient.Authenticate(string(uname), string(password))
+	pass, userFilters, err := splitFilters(string(password))
 	if err != nil {
 		client.Write([]byte{0x05, 0x01})
-		return fmt.Errorf("auth credentials worng in socks5")
+		return nil, filters.Filters{}, err
+	}
+
+	authresp, err := s.authClient.Authenticate(string(uname), pass)
+	if err != nil {
+		client.Write([]byte{0x05, 0x01})
+		return nil, filters.Filters{}, fmt.Errorf("auth credentials worng in socks5")
 	}
 
 	client.Write([]byte{0x05, 0x00})
 
-	return nil
+	return authresp, userFilters, nil
 }
 
-func requestHandShake(client io.Reader) (string, error) {
+// requestHandShake reads the client's request and returns its command and
+// DST address.
+func requestHandShake(client io.Reader) (byte, string, error) {
 	header := make([]byte, 4)
 	if _, err := io.ReadFull(client, header); err != nil {
-		return "", err
+		return 0, "", err
 	}
 
 	if header[0] != PROXY_VERSION {
-		return "", fmt.Errorf("unsupported SOCKS version: %d", header[0])
+		return 0, "", fmt.Errorf("unsupported SOCKS version: %d", header[0])
 	}
 
-	if header[1] != CMD_CONNECT {
-		return "", fmt.Errorf("unsupported command: %d", header[1])
+	addr, err := readAddr(client, header[3])
+	if err != nil {
+		return 0, "", err
 	}
 
+	return header[1], addr, nil
+}
+
+// readAddr reads an RFC 1928 DST/BND address of type addrType followed by
+// its port and returns it as host:port.
+func readAddr(client io.Reader, addrType byte) (string, error) {
 	var host string
-	addrType := header[3]
 
 	switch addrType {
 	case 0x01: // IPv4
@@ -179,7 +333,7 @@ func requestHandShake(client io.Reader) (string, error) {
 		}
 		host = net.IP(ip).String()
 	default:
-		return "", fmt.Errorf("unknown address type: %d", addrType)
+		return "", fmt.Errorf("%w: %d", errAddressType, addrType)
 	}
 
 	// Read Port (2 bytes, big-endian)
@@ -192,9 +346,51 @@ func requestHandShake(client io.Reader) (string, error) {
 	return net.JoinHostPort(host, strconv.Itoa(int(port))), nil
 }
 
+// replyCode maps a failure to reach the destination to its reply code.
+// Upstream SOCKS5 codes are passed on and upstream HTTP statuses are
+// translated.
+func replyCode(err error) byte {
+	var replyErr *socksReplyError
+	var statusErr *connectStatusError
+	var dnsErr *net.DNSError
+	var netErr net.Error
+
+	switch {
+	case errors.As(err, &replyErr):
+		return replyErr.Code
+	case errors.As(err, &statusErr):
+		switch statusErr.StatusCode {
+		case http.StatusForbidden, http.StatusProxyAuthRequired:
+			return REP_NOT_ALLOWED
+		case http.StatusBadGateway, http.StatusServiceUnavailable:
+			return REP_HOST_UNREACHABLE
+		case http.StatusGatewayTimeout:
+			return REP_TTL_EXPIRED
+		}
+		return REP_GENERAL_FAILURE
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return REP_CONNECTION_REFUSED
+	case errors.Is(err, syscall.ENETUNREACH):
+		return REP_NETWORK_UNREACHABLE
+	case errors.Is(err, syscall.EHOSTUNREACH), errors.As(err, &dnsErr):
+		return REP_HOST_UNREACHABLE
+	case errors.As(err, &netErr) && netErr.Timeout():
+		return REP_TTL_EXPIRED
+	}
+	return REP_GENERAL_FAILURE
+}
+
 func sendReply(client io.Writer, rep byte, addr net.Addr) error {
 	// [VER | REP | RSV | ATYP | BND.ADDR | BND.PORT]
-	reply := []byte{PROXY_VERSION, rep, 0x00, 0x01, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00}
-	_, err := client.Write(reply)
+	reply := []byte{PROXY_VERSION, rep, 0x00}
+
+	bound := []byte{0x01, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00}
+	if addr != nil {
+		if encoded, err := encodeHostPort(addr.String()); err == nil {
+			bound = encoded
+		}
+	}
+
+	_, err := client.Write(append(reply, bound...))
 	return err
 }
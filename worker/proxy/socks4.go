@@ -0,0 +1,162 @@
+package proxy
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	SOCKS4_VERSION = byte(0x04)
+
+	socks4Granted  = byte(0x5A)
+	socks4Rejected = byte(0x5B)
+
+	// maxSocks4Field bounds the NUL terminated USERID and HOSTNAME fields.
+	maxSocks4Field = 255
+)
+
+// handleSocks4 serves a SOCKS4 or SOCKS4a CONNECT. SOCKS4 has no auth
+// method, so the USERID field carries "username:password" optionally
+// followed by filters, the same as the HTTP proxy's credentials.
+func (s *SocksProxy) handleSocks4(client net.Conn, r *bufio.Reader) {
+	cmd, destAddr, userID, err := socks4Request(r)
+	if err != nil {
+		log.Printf("SOCKS4 request failed: %s", err)
+		sendSocks4Reply(client, socks4Rejected)
+		return
+	}
+	client.SetDeadline(time.Time{})
+
+	if cmd != CMD_CONNECT {
+		log.Printf("Unsupported SOCKS4 command: %d", cmd)
+		sendSocks4Reply(client, socks4Rejected)
+		return
+	}
+
+	username, password, userFilters, err := splitCredentials(userID)
+	if err != nil {
+		log.Printf("SOCKS4 authentication failed: %s", err)
+		sendSocks4Reply(client, socks4Rejected)
+		return
+	}
+
+	authresp, err := s.authClient.Authenticate(username, password)
+	if err != nil {
+		log.Printf("SOCKS4 authentication failed: %s", err)
+		sendSocks4Reply(client, socks4Rejected)
+		return
+	}
+
+	if authresp.DataUsed >= authresp.DataLimit {
+		log.Printf("Data limit reached for user %s", authresp.UserID)
+		sendSocks4Reply(client, socks4Rejected)
+		return
+	}
+
+	selectedPool := selectPool(authresp.AllowedPools, s.ConfigManager.GetPools(), userFilters.Pool)
+	if selectedPool == nil {
+		log.Printf("No allowed pools for user %s", authresp.UserID)
+		sendSocks4Reply(client, socks4Rejected)
+		return
+	}
+
+	upstream := s.sessionMap.selectUpstream(selectedPool, authresp.UserID, userFilters)
+	if upstream == nil {
+		log.Printf("No upstreams in pool %s", selectedPool.Name)
+		sendSocks4Reply(client, socks4Rejected)
+		return
+	}
+
+	// SOCKS4a host names are passed on to the upstream so they are
+	// resolved at the exit rather than on the worker.
+	var dest net.Conn
+	release, err := s.sessionMap.failover(selectedPool, upstream, authresp.UserID, userFilters, s.Retry, s.stats, func(u *url.URL, deadline time.Time) (bool, error) {
+		conn, _, err := dialUpstream(u, destAddr, deadline)
+		dest = conn
+		return true, err
+	})
+	if err != nil {
+		log.Printf("Failed to connect to destination %s: %v", destAddr, err)
+		sendSocks4Reply(client, socks4Rejected)
+		return
+	}
+	defer release()
+	defer dest.Close()
+
+	if err := sendSocks4Reply(client, socks4Granted); err != nil {
+		log.Printf("Failed to send SOCKS4 reply: %v", err)
+		return
+	}
+
+	log.Printf("Tunneling SOCKS4 data for %s", destAddr)
+	add, done := s.sessionMap.track(authresp.UserID, userFilters, dest)
+	sent, received := tunnel(s.stats, client, dest, add)
+	done()
+	s.usageRepoter.ReportUsage(authresp.UserID, sent+received)
+	log.Printf("Connection closed for %s", destAddr)
+}
+
+// socks4Request reads [VN | CD | DSTPORT | DSTIP | USERID NUL] and, for
+// SOCKS4a's 0.0.0.x DSTIP, the HOSTNAME NUL that follows.
+func socks4Request(r *bufio.Reader) (byte, string, string, error) {
+	header := make([]byte, 8)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return 0, "", "", fmt.Errorf("failed to read header: %w", err)
+	}
+	if header[0] != SOCKS4_VERSION {
+		return 0, "", "", fmt.Errorf("unsupported SOCKS version: %d", header[0])
+	}
+
+	port := binary.BigEndian.Uint16(header[2:4])
+	ip := net.IP(header[4:8])
+
+	userID, err := readNulString(r)
+	if err != nil {
+		return 0, "", "", fmt.Errorf("failed to read userid: %w", err)
+	}
+
+	host := ip.String()
+	if ip[0] == 0 && ip[1] == 0 && ip[2] == 0 && ip[3] != 0 {
+		host, err = readNulString(r)
+		if err != nil {
+			return 0, "", "", fmt.Errorf("failed to read hostname: %w", err)
+		}
+		if host == "" {
+			return 0, "", "", errors.New("empty SOCKS4a hostname")
+		}
+	}
+
+	return header[1], net.JoinHostPort(host, strconv.Itoa(int(port))), userID, nil
+}
+
+func readNulString(r *bufio.Reader) (string, error) {
+	var b strings.Builder
+	for {
+		c, err := r.ReadByte()
+		if err != nil {
+			return "", err
+		}
+		if c == 0x00 {
+			return b.String(), nil
+		}
+		if b.Len() >= maxSocks4Field {
+			return "", errors.New("field too long")
+		}
+		b.WriteByte(c)
+	}
+}
+
+func sendSocks4Reply(client io.Writer, status byte) error {
+	// [VN | CD | DSTPORT | DSTIP]
+	_, err := client.Write([]byte{0x00, status, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00})
+	return err
+}
@@ -0,0 +1,113 @@
+package proxy
+
+import (
+	"log"
+	"net"
+	"time"
+
+	"github.com/pubudu2003060/go-proxy-prototype/worker/models"
+)
+
+// handleBind serves an RFC 1928 BIND request. The first reply carries the
+// address the worker listens on, the second one the address of the peer
+// that connected to it, after which both are tunnelled. Upstreams cannot
+// accept connections for us, so the listener is on the worker itself.
+func (s *SocksProxy) handleBind(client net.Conn, authresp *models.AuthResponse, destAddr string) {
+	if !s.acquireBind(authresp.UserID) {
+		log.Printf("User %s reached the limit of %d BIND sockets", authresp.UserID, s.MaxBindsPerUser)
+		sendReply(client, REP_NOT_ALLOWED, nil)
+		return
+	}
+	defer s.releaseBind(authresp.UserID)
+
+	localIP := client.LocalAddr().(*net.TCPAddr).IP
+	listener, err := net.ListenTCP("tcp", &net.TCPAddr{IP: localIP})
+	if err != nil {
+		log.Printf("Failed to bind listener: %v", err)
+		sendReply(client, REP_GENERAL_FAILURE, nil)
+		return
+	}
+	defer listener.Close()
+
+	if err := sendReply(client, REP_SUCCEEDED, s.publicAddr(listener.Addr())); err != nil {
+		log.Printf("Failed to send first BIND reply: %v", err)
+		return
+	}
+
+	listener.SetDeadline(time.Now().Add(s.BindTimeout))
+	inbound, err := listener.AcceptTCP()
+	if err != nil {
+		log.Printf("No inbound connection for BIND on %s: %v", listener.Addr(), err)
+		sendReply(client, REP_TTL_EXPIRED, nil)
+		return
+	}
+	defer inbound.Close()
+	listener.Close()
+
+	// DST.ADDR names the host expected to connect, reject anyone else.
+	if host, _, err := net.SplitHostPort(destAddr); err == nil {
+		expected := net.ParseIP(host)
+		peer := inbound.RemoteAddr().(*net.TCPAddr).IP
+		if expected != nil && !expected.IsUnspecified() && !expected.Equal(peer) {
+			log.Printf("BIND expected %s but %s connected", expected, peer)
+			sendReply(client, REP_NOT_ALLOWED, nil)
+			return
+		}
+	}
+
+	if err := sendReply(client, REP_SUCCEEDED, inbound.RemoteAddr()); err != nil {
+		log.Printf("Failed to send second BIND reply: %v", err)
+		return
+	}
+
+	log.Printf("Tunneling BIND data for %s", inbound.RemoteAddr())
+	sent, received := tunnel(s.stats, client, inbound, func(int64) {})
+	s.usageRepoter.ReportUsage(authresp.UserID, sent+received)
+}
+
+// publicAddr is the address clients and peers are told to reach a socket
+// on addr at: the host of PublicAddr, which may carry a port of its own,
+// with the socket's port.
+func (s *SocksProxy) publicAddr(addr net.Addr) net.Addr {
+	if s.PublicAddr == "" {
+		return addr
+	}
+
+	host, _, err := net.SplitHostPort(s.PublicAddr)
+	if err != nil {
+		host = s.PublicAddr
+	}
+	_, port, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return addr
+	}
+	return hostPort(net.JoinHostPort(host, port))
+}
+
+// hostPort is an address whose host may be a name. Replies only use its
+// string form.
+type hostPort string
+
+func (a hostPort) Network() string { return "tcp" }
+func (a hostPort) String() string  { return string(a) }
+
+func (s *SocksProxy) acquireBind(userID string) bool {
+	s.bindMu.Lock()
+	defer s.bindMu.Unlock()
+
+	if s.binds[userID] >= s.MaxBindsPerUser {
+		return false
+	}
+	s.binds[userID]++
+	return true
+}
+
+func (s *SocksProxy) releaseBind(userID string) {
+	s.bindMu.Lock()
+	defer s.bindMu.Unlock()
+
+	s.binds[userID]--
+	if s.binds[userID] <= 0 {
+		delete(s.binds, userID)
+	}
+}
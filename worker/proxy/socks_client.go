@@ -0,0 +1,131 @@
+package proxy
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"strconv"
+)
+
+// socks5Connect asks the SOCKS5 upstream on conn to connect to dest and
+// returns the address the upstream bound for it.
+func socks5Connect(conn net.Conn, user *url.Userinfo, dest string) (string, error) {
+	if err := socks5Auth(conn, user); err != nil {
+		return "", err
+	}
+
+	return socks5Request(conn, CMD_CONNECT, dest)
+}
+
+func socks5Auth(conn net.Conn, user *url.Userinfo) error {
+	method := byte(0x00)
+	if user != nil {
+		method = Uandp
+	}
+
+	if _, err := conn.Write([]byte{PROXY_VERSION, 0x01, method}); err != nil {
+		return fmt.Errorf("send SOCKS5 greeting: %w", err)
+	}
+
+	reply := make([]byte, 2)
+	if _, err := io.ReadFull(conn, reply); err != nil {
+		return fmt.Errorf("read SOCKS5 greeting reply: %w", err)
+	}
+	if reply[0] != PROXY_VERSION || reply[1] != method {
+		return fmt.Errorf("upstream rejected SOCKS5 auth method %d", method)
+	}
+
+	if user == nil {
+		return nil
+	}
+
+	username := user.Username()
+	password, _ := user.Password()
+	if len(username) > 255 || len(password) > 255 {
+		return errors.New("upstream credentials too long for SOCKS5")
+	}
+
+	req := []byte{0x01, byte(len(username))}
+	req = append(req, username...)
+	req = append(req, byte(len(password)))
+	req = append(req, password...)
+	if _, err := conn.Write(req); err != nil {
+		return fmt.Errorf("send SOCKS5 credentials: %w", err)
+	}
+
+	if _, err := io.ReadFull(conn, reply); err != nil {
+		return fmt.Errorf("read SOCKS5 auth reply: %w", err)
+	}
+	if reply[1] != 0x00 {
+		return errors.New("upstream rejected SOCKS5 credentials")
+	}
+
+	return nil
+}
+
+// socks5Request sends cmd for addr and returns the BND address from the
+// reply.
+func socks5Request(conn net.Conn, cmd byte, addr string) (string, error) {
+	encoded, err := encodeHostPort(addr)
+	if err != nil {
+		return "", err
+	}
+
+	req := append([]byte{PROXY_VERSION, cmd, 0x00}, encoded...)
+	if _, err := conn.Write(req); err != nil {
+		return "", fmt.Errorf("send SOCKS5 request: %w", err)
+	}
+
+	header := make([]byte, 4)
+	if _, err := io.ReadFull(conn, header); err != nil {
+		return "", fmt.Errorf("read SOCKS5 reply: %w", err)
+	}
+	if header[0] != PROXY_VERSION {
+		return "", fmt.Errorf("unexpected SOCKS version %d from upstream", header[0])
+	}
+	if header[1] != 0x00 {
+		return "", &socksReplyError{Code: header[1]}
+	}
+
+	return readAddr(conn, header[3])
+}
+
+// encodeHostPort encodes host:port as an RFC 1928 ATYP, address and port.
+func encodeHostPort(hostPort string) ([]byte, error) {
+	host, portStr, err := net.SplitHostPort(hostPort)
+	if err != nil {
+		return nil, err
+	}
+	port, err := strconv.ParseUint(portStr, 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("invalid port %q", portStr)
+	}
+
+	var buf []byte
+	if ip := net.ParseIP(host); ip != nil {
+		if ip4 := ip.To4(); ip4 != nil {
+			buf = append([]byte{0x01}, ip4...)
+		} else {
+			buf = append([]byte{0x04}, ip.To16()...)
+		}
+	} else {
+		if len(host) > 255 {
+			return nil, fmt.Errorf("host name too long: %s", host)
+		}
+		buf = append([]byte{0x03, byte(len(host))}, host...)
+	}
+
+	return binary.BigEndian.AppendUint16(buf, uint16(port)), nil
+}
+
+// socksReplyError is a non-success reply from a SOCKS5 upstream.
+type socksReplyError struct {
+	Code byte
+}
+
+func (e *socksReplyError) Error() string {
+	return fmt.Sprintf("upstream SOCKS5 request failed with code %d", e.Code)
+}
@@ -0,0 +1,229 @@
+package proxy
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"net/url"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pubudu2003060/go-proxy-prototype/worker/models"
+)
+
+const maxDatagramSize = 65535
+
+// handleUDPAssociate serves an RFC 1928 UDP ASSOCIATE request. It binds a
+// relay socket next to the TCP control connection and relays datagrams
+// until the control connection closes. Datagrams only ever leave through
+// u, which must be an out with SOCKS5 UDP support, so the worker's own
+// address is never exposed.
+func (s *SocksProxy) handleUDPAssociate(client net.Conn, authresp *models.AuthResponse, u *url.URL, clientHint string) {
+	localIP := client.LocalAddr().(*net.TCPAddr).IP
+	relayConn, err := net.ListenUDP("udp", &net.UDPAddr{IP: localIP})
+	if err != nil {
+		log.Printf("Failed to bind UDP relay: %v", err)
+		sendReply(client, REP_GENERAL_FAILURE, nil)
+		return
+	}
+	defer relayConn.Close()
+
+	relay := &udpRelay{
+		relay:    relayConn,
+		clientIP: client.RemoteAddr().(*net.TCPAddr).IP,
+		s:        s,
+	}
+
+	// RFC 1928 lets the client announce the address it will send from.
+	// Zero fields mean it does not know yet.
+	if hintHost, hintPort, err := net.SplitHostPort(clientHint); err == nil && hintPort != "0" {
+		if ip := net.ParseIP(hintHost); ip != nil && !ip.IsUnspecified() {
+			relay.clientAddr, _ = net.ResolveUDPAddr("udp", clientHint)
+		}
+	}
+
+	control, upstreamConn, err := associateUpstream(u)
+	if err != nil {
+		log.Printf("Failed to open UDP association with upstream %s: %v", u.Host, err)
+		sendReply(client, REP_GENERAL_FAILURE, nil)
+		return
+	}
+	defer control.Close()
+	defer upstreamConn.Close()
+	relay.upstream = upstreamConn
+
+	if err := sendReply(client, REP_SUCCEEDED, s.publicAddr(relayConn.LocalAddr())); err != nil {
+		log.Printf("Failed to send success reply: %v", err)
+		return
+	}
+
+	log.Printf("UDP relay for %s on %s", relay.clientIP, relayConn.LocalAddr())
+
+	go relay.clientToRemote()
+	go relay.remoteToClient()
+
+	// The association lives as long as the TCP control connection.
+	io.Copy(io.Discard, client)
+
+	relayConn.Close()
+	upstreamConn.Close()
+
+	s.usageRepoter.ReportUsage(authresp.UserID, relay.sent.Load()+relay.received.Load())
+	log.Printf("UDP relay closed for %s", relay.clientIP)
+}
+
+type udpRelay struct {
+	relay      *net.UDPConn
+	clientIP   net.IP
+	clientAddr *net.UDPAddr
+	upstream   *net.UDPConn
+	s          *SocksProxy
+	sent       atomic.Int64
+	received   atomic.Int64
+	mu         sync.RWMutex
+}
+
+// allowed reports whether src may use the relay. Only the associating
+// client's IP is accepted and the first datagram pins its port.
+func (r *udpRelay) allowed(src *net.UDPAddr) bool {
+	if !src.IP.Equal(r.clientIP) {
+		return false
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.clientAddr == nil {
+		r.clientAddr = src
+		return true
+	}
+	return r.clientAddr.Port == src.Port
+}
+
+func (r *udpRelay) client() *net.UDPAddr {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	return r.clientAddr
+}
+
+func (r *udpRelay) clientToRemote() {
+	buf := make([]byte, maxDatagramSize)
+	for {
+		n, src, err := r.relay.ReadFromUDP(buf)
+		if err != nil {
+			return
+		}
+		if !r.allowed(src) {
+			continue
+		}
+
+		_, payload, err := parseUDPHeader(buf[:n])
+		if err != nil {
+			continue
+		}
+
+		// The upstream speaks the same encapsulation, forward as is.
+		if _, err := r.upstream.Write(buf[:n]); err != nil {
+			continue
+		}
+
+		r.sent.Add(int64(len(payload)))
+		r.s.stats.AddIn(int64(len(payload)))
+	}
+}
+
+func (r *udpRelay) remoteToClient() {
+	buf := make([]byte, maxDatagramSize)
+	for {
+		n, err := r.upstream.Read(buf)
+		if err != nil {
+			return
+		}
+		_, payload, err := parseUDPHeader(buf[:n])
+		if err != nil {
+			continue
+		}
+		datagram, size := buf[:n], len(payload)
+
+		client := r.client()
+		if client == nil {
+			continue
+		}
+		if _, err := r.relay.WriteToUDP(datagram, client); err != nil {
+			continue
+		}
+
+		r.received.Add(int64(size))
+		r.s.stats.AddOut(int64(size))
+	}
+}
+
+// parseUDPHeader splits a SOCKS5 UDP datagram into its destination and
+// payload. Fragmented datagrams are not supported and are rejected.
+func parseUDPHeader(datagram []byte) (string, []byte, error) {
+	// [RSV(2) | FRAG | ATYP | DST.ADDR | DST.PORT | DATA]
+	if len(datagram) < 4 {
+		return "", nil, errors.New("short UDP datagram")
+	}
+	if datagram[2] != 0x00 {
+		return "", nil, errors.New("fragmented UDP datagram")
+	}
+
+	r := bytes.NewReader(datagram[4:])
+	dest, err := readAddr(r, datagram[3])
+	if err != nil {
+		return "", nil, err
+	}
+
+	return dest, datagram[len(datagram)-r.Len():], nil
+}
+
+// associateUpstream opens a UDP association with a SOCKS5 upstream. The
+// returned TCP connection must stay open for the association to live.
+func associateUpstream(u *url.URL) (net.Conn, *net.UDPConn, error) {
+	control, err := net.DialTimeout("tcp", u.Host, upstreamDialTimeout)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	control.SetDeadline(time.Now().Add(upstreamDialTimeout))
+	if err := socks5Auth(control, u.User); err != nil {
+		control.Close()
+		return nil, nil, err
+	}
+
+	bound, err := socks5Request(control, CMD_UDP_ASSOCIATE, "0.0.0.0:0")
+	if err != nil {
+		control.Close()
+		return nil, nil, err
+	}
+	control.SetDeadline(time.Time{})
+
+	relayAddr, err := net.ResolveUDPAddr("udp", bound)
+	if err != nil {
+		control.Close()
+		return nil, nil, err
+	}
+	// An unspecified BND.ADDR means the relay is on the upstream's host.
+	if relayAddr.IP.IsUnspecified() {
+		host, _, _ := net.SplitHostPort(u.Host)
+		ip, err := net.ResolveIPAddr("ip", host)
+		if err != nil {
+			control.Close()
+			return nil, nil, err
+		}
+		relayAddr.IP = ip.IP
+	}
+
+	conn, err := net.DialUDP("udp", nil, relayAddr)
+	if err != nil {
+		control.Close()
+		return nil, nil, err
+	}
+
+	return control, conn, nil
+}
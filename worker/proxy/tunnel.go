@@ -0,0 +1,56 @@
+package proxy
+
+import (
+	"io"
+	"net"
+
+	"github.com/pubudu2003060/go-proxy-prototype/worker/stats"
+)
+
+// tunnel copies data both ways between client and upstream until either
+// side is done, then closes both. Bytes are passed to add as they go. It
+// returns the bytes sent by the client and the bytes received from
+// upstream.
+func tunnel(st *stats.Stats, client, upstream net.Conn, add func(int64)) (int64, int64) {
+	sentCh := make(chan int64, 1)
+	go func() {
+		n, _ := io.Copy(&countingWriter{w: upstream, add: func(n int64) {
+			st.AddIn(n)
+			add(n)
+		}}, client)
+		upstream.Close()
+		client.Close()
+		sentCh <- n
+	}()
+
+	received, _ := io.Copy(&countingWriter{w: client, add: func(n int64) {
+		st.AddOut(n)
+		add(n)
+	}}, upstream)
+	upstream.Close()
+	client.Close()
+
+	return <-sentCh, received
+}
+
+type countingWriter struct {
+	w   io.Writer
+	add func(int64)
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.add(int64(n))
+	return n, err
+}
+
+type countingReader struct {
+	r   io.Reader
+	add func(int64)
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.add(int64(n))
+	return n, err
+}
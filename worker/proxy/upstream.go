@@ -0,0 +1,512 @@
+package proxy
+
+import (
+	"bufio"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"maps"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pubudu2003060/go-proxy-prototype/filters"
+	"github.com/pubudu2003060/go-proxy-prototype/provider"
+	"github.com/pubudu2003060/go-proxy-prototype/schema"
+	"github.com/pubudu2003060/go-proxy-prototype/worker/balancer"
+	"github.com/pubudu2003060/go-proxy-prototype/worker/health"
+	"github.com/pubudu2003060/go-proxy-prototype/worker/models"
+	"github.com/pubudu2003060/go-proxy-prototype/worker/session"
+	"github.com/pubudu2003060/go-proxy-prototype/worker/stats"
+)
+
+const upstreamDialTimeout = 10 * time.Second
+
+// RetryPolicy bounds failover to the other outs of a pool when connecting
+// through an upstream fails.
+type RetryPolicy struct {
+	// MaxAttempts includes the first try; 1 disables failover.
+	MaxAttempts int
+	// AttemptTimeout bounds the dial and handshake with one upstream, and
+	// for plain HTTP requests the wait for the response headers.
+	AttemptTimeout time.Duration
+	// TotalTimeout bounds all attempts together.
+	TotalTimeout time.Duration
+}
+
+var DefaultRetryPolicy = RetryPolicy{
+	MaxAttempts:    3,
+	AttemptTimeout: upstreamDialTimeout,
+	TotalTimeout:   30 * time.Second,
+}
+
+// selectPool returns the first of the user's allowed pools served by this
+// worker, or the pool the user asked for when it is allowed.
+func selectPool(allowedPools []string, pools map[string]*models.Pool, want string) *models.Pool {
+	for _, poolName := range allowedPools {
+		name := strings.TrimSpace(poolName)
+		name = strings.ToLower(name)
+		if want != "" && name != want {
+			continue
+		}
+		if pool, exit := pools[name]; exit {
+			return pool
+		}
+	}
+
+	return nil
+}
+
+// sessionTable pins sticky sessions to the upstream they first used in
+// the worker's session store. A new sticky session gets the out its user
+// and session ID hash to, so it lands on the same upstream whichever
+// worker the client reaches. Everything else is spread over the pool's
+// healthy outs by the balancer.
+type sessionTable struct {
+	balancer *balancer.Balancer
+	health   *health.Checker
+	sessions *session.Store
+}
+
+func newSessionTable(balancer *balancer.Balancer, health *health.Checker, sessions *session.Store) *sessionTable {
+	return &sessionTable{
+		balancer: balancer,
+		health:   health,
+		sessions: sessions,
+	}
+}
+
+// unhealthy returns the indices of the outs of pool whose circuit is not
+// closed. When none is healthy it returns nil so that the pool is tried
+// anyway rather than failing every request.
+func (t *sessionTable) unhealthy(pool *models.Pool) map[int]bool {
+	skip := make(map[int]bool)
+	for i := range pool.Outs {
+		if !t.health.Healthy(&pool.Outs[i]) {
+			skip[i] = true
+		}
+	}
+	if len(skip) == len(pool.Outs) {
+		return nil
+	}
+	return skip
+}
+
+func (t *sessionTable) selectUpstream(pool *models.Pool, userID string, f filters.Filters) *models.Out {
+	if len(pool.Outs) == 0 {
+		return nil
+	}
+
+	if f.Sticky() {
+		upstreamKey, exists := t.sessions.Get(session.Key{UserID: userID, Session: f.Session})
+		if exists {
+			for i := range pool.Outs {
+				if outKey(&pool.Outs[i]) == upstreamKey && t.health.Healthy(&pool.Outs[i]) {
+					return &pool.Outs[i]
+				}
+			}
+		}
+	}
+
+	selected := &pool.Outs[t.next(pool, userID, f, t.unhealthy(pool))]
+	t.pin(pool, userID, f, selected)
+
+	return selected
+}
+
+// selectUDPUpstream is selectUpstream among the outs of pool that relay
+// UDP, or nil when none does. A sticky session pinned to an out without
+// UDP keeps its pin for TCP.
+func (t *sessionTable) selectUDPUpstream(pool *models.Pool, userID string, f filters.Filters) *models.Out {
+	noUDP := make(map[int]bool)
+	for i := range pool.Outs {
+		if !pool.Outs[i].UDP {
+			noUDP[i] = true
+		}
+	}
+	if len(noUDP) == len(pool.Outs) {
+		return nil
+	}
+
+	pinned := false
+	if f.Sticky() {
+		upstreamKey, exists := t.sessions.Get(session.Key{UserID: userID, Session: f.Session})
+		if exists {
+			for i := range pool.Outs {
+				if outKey(&pool.Outs[i]) == upstreamKey && pool.Outs[i].UDP && t.health.Healthy(&pool.Outs[i]) {
+					return &pool.Outs[i]
+				}
+			}
+		}
+		pinned = exists
+	}
+
+	healthy := maps.Clone(noUDP)
+	maps.Copy(healthy, t.unhealthy(pool))
+
+	next := t.pick(pool, userID, f, healthy)
+	if next < 0 {
+		next = t.pick(pool, userID, f, noUDP)
+	}
+	selected := &pool.Outs[next]
+	if !pinned {
+		t.pin(pool, userID, f, selected)
+	}
+
+	return selected
+}
+
+// next picks an out of pool that is not in skip, or any out when skip
+// covers them all.
+func (t *sessionTable) next(pool *models.Pool, userID string, f filters.Filters, skip map[int]bool) int {
+	if next := t.pick(pool, userID, f, skip); next >= 0 {
+		return next
+	}
+	return t.pick(pool, userID, f, nil)
+}
+
+// pick picks an out of pool that is not in skip, or -1 when skip covers
+// them all. Sticky sessions hash to their out.
+func (t *sessionTable) pick(pool *models.Pool, userID string, f filters.Filters, skip map[int]bool) int {
+	if f.Sticky() {
+		return balancer.Rendezvous(pool, userID+"\x00"+f.Session, skip)
+	}
+	return t.balancer.NextExcept(pool, skip)
+}
+
+// pin keeps a sticky session on out for the lifetime it asked for, or the
+// pool provider's default.
+func (t *sessionTable) pin(pool *models.Pool, userID string, f filters.Filters, out *models.Out) {
+	if !f.Sticky() {
+		return
+	}
+
+	lifetime := f.Lifetime
+	if f.Rotation == filters.RotateInterval {
+		lifetime = f.RotateEvery
+	}
+	if lifetime == 0 {
+		lifetime = provider.Lookup(pool.Provider).DefaultLifetime
+	}
+	t.sessions.Set(session.Key{UserID: userID, Session: f.Session}, outKey(out), f.Country, lifetime)
+}
+
+// track lets the session store close conn when the sticky session it
+// belongs to is killed, until done is called. add counts the bytes conn
+// carries towards the session.
+func (t *sessionTable) track(userID string, f filters.Filters, conn io.Closer) (add func(bytes int64), done func()) {
+	if !f.Sticky() {
+		return func(int64) {}, func() {}
+	}
+	return t.sessions.Track(session.Key{UserID: userID, Session: f.Session}, conn)
+}
+
+// upstreamURL is upstreamURL for a request of userID, with its sticky
+// session as the store knows it.
+func (t *sessionTable) upstreamURL(pool *models.Pool, out *models.Out, userID string, f filters.Filters) (*url.URL, error) {
+	if !f.Sticky() {
+		return upstreamURL(pool, out, f, stickySession{})
+	}
+
+	key := session.Key{UserID: userID, Session: f.Session}
+	return upstreamURL(pool, out, f, stickySession{
+		userID:     userID,
+		generation: t.sessions.Generation(key),
+	})
+}
+
+// stickySession is what the upstream session ID of a sticky session is
+// derived from besides the client's session ID.
+type stickySession struct {
+	userID     string
+	generation int
+}
+
+// filters returns f with the session ID the upstream sees. The store and
+// captain know sessions by the client's ID; the upstream gets a hash of
+// the user, that ID and the session's generation, so users never share an
+// exit by picking the same ID and a killed session gets a fresh one.
+// Interval sessions, and sessions with a lifetime the template cannot
+// pass on, also hash in the start of their current window, aligned to the
+// epoch so every worker derives the same ID, and the exit changes when it
+// ends.
+func (s stickySession) filters(p *provider.Provider, tmpl *provider.Template, f filters.Filters) filters.Filters {
+	parts := []string{s.userID, f.Session, strconv.Itoa(s.generation)}
+
+	switch {
+	case f.Rotation == filters.RotateInterval:
+		// Providers that take a lifetime hold the exit for exactly one
+		// interval.
+		f.Lifetime = f.RotateEvery
+		parts = append(parts, strconv.FormatInt(filters.Window(f.RotateEvery, time.Now()).Unix(), 10))
+	case f.Lifetime > 0 && !tmpl.Uses("lifetime") && !tmpl.Uses("lifetime_m"):
+		parts = append(parts, strconv.FormatInt(filters.Window(f.Lifetime, time.Now()).Unix(), 10))
+	}
+
+	f.Session = p.DeriveSession(parts...)
+	return f
+}
+
+// failover calls try with the upstream of first and, while try reports the
+// error as retryable, with the next healthy outs of pool by weight until
+// policy runs out. try gets the deadline for its attempt and must only
+// call an error retryable when nothing from the client has been forwarded
+// yet. Sticky sessions move to the out that worked, and every attempt is
+// reported to the health checker.
+//
+// The connection counts as in flight on the out that worked until the
+// caller calls the returned release, and the time try took there is its
+// time to first byte.
+func (t *sessionTable) failover(pool *models.Pool, first *models.Out, userID string, f filters.Filters, policy RetryPolicy, st *stats.Stats, try func(u *url.URL, deadline time.Time) (bool, error)) (func(), error) {
+	deadline := time.Now().Add(policy.TotalTimeout)
+	tried := make(map[int]bool)
+	out := first
+
+	for attempt := 1; ; attempt++ {
+		for i := range pool.Outs {
+			if &pool.Outs[i] == out {
+				tried[i] = true
+			}
+		}
+
+		u, err := t.upstreamURL(pool, out, userID, f)
+		if err == nil {
+			attemptDeadline := time.Now().Add(policy.AttemptTimeout)
+			if attemptDeadline.After(deadline) {
+				attemptDeadline = deadline
+			}
+
+			t.balancer.Begin(out)
+			start := time.Now()
+
+			var retryable bool
+			retryable, err = try(u, attemptDeadline)
+			if err == nil {
+				t.balancer.Observe(out, time.Since(start))
+				t.health.Record(out, nil)
+				if out != first {
+					t.pin(pool, userID, f, out)
+				}
+				done := out
+				return func() { t.balancer.End(done) }, nil
+			}
+			t.balancer.End(out)
+			if !retryable {
+				return nil, err
+			}
+			if upstreamFault(err) {
+				t.balancer.Fail(out)
+				t.health.Record(out, err)
+			} else {
+				t.health.Record(out, nil)
+			}
+		}
+
+		if attempt >= policy.MaxAttempts || !time.Now().Before(deadline) {
+			return nil, err
+		}
+		next := t.nextUntried(pool, userID, f, tried)
+		if next < 0 {
+			return nil, err
+		}
+
+		log.Printf("Upstream %s failed: %v; retrying on %s", outKey(out), err, outKey(&pool.Outs[next]))
+		st.UpstreamRetried()
+		out = &pool.Outs[next]
+	}
+}
+
+// nextUntried prefers healthy outs but falls back to unhealthy ones that
+// have not been tried yet. It returns -1 once no out is left to try.
+func (t *sessionTable) nextUntried(pool *models.Pool, userID string, f filters.Filters, tried map[int]bool) int {
+	skip := t.unhealthy(pool)
+	if skip == nil {
+		skip = make(map[int]bool)
+	}
+	for i := range tried {
+		skip[i] = true
+	}
+
+	for _, skip := range []map[int]bool{skip, tried} {
+		if next := t.next(pool, userID, f, skip); next >= 0 && !tried[next] {
+			return next
+		}
+	}
+	return -1
+}
+
+// upstreamFault reports whether err says the upstream itself is broken,
+// as opposed to the upstream reporting that the destination could not be
+// reached.
+func upstreamFault(err error) bool {
+	var statusErr *connectStatusError
+	if errors.As(err, &statusErr) {
+		switch statusErr.StatusCode {
+		case http.StatusBadGateway, http.StatusGatewayTimeout:
+			return false
+		}
+		return true
+	}
+
+	var replyErr *socksReplyError
+	if errors.As(err, &replyErr) {
+		switch replyErr.Code {
+		case REP_NETWORK_UNREACHABLE, REP_HOST_UNREACHABLE, REP_CONNECTION_REFUSED, REP_TTL_EXPIRED:
+			return false
+		}
+		return true
+	}
+
+	return true
+}
+
+// ProbeUpstream connects to target through out the way a client request
+// would, without filters, and closes the tunnel. It is the health
+// checker's active probe.
+func ProbeUpstream(pool *models.Pool, out *models.Out, target string, timeout time.Duration) error {
+	u, err := upstreamURL(pool, out, filters.Filters{}, stickySession{})
+	if err != nil {
+		return err
+	}
+
+	conn, _, err := dialUpstream(u, target, time.Now().Add(timeout))
+	if err != nil {
+		return err
+	}
+	return conn.Close()
+}
+
+func outKey(out *models.Out) string {
+	return net.JoinHostPort(out.Domain, strconv.Itoa(out.UpstreamPort))
+}
+
+// upstreamURL builds the address and credentials for out. The
+// credentials come from rendering out's format, or the pool provider's
+// template, with the request's filters and, for sticky sessions, the
+// session's state.
+func upstreamURL(pool *models.Pool, out *models.Out, f filters.Filters, sticky stickySession) (*url.URL, error) {
+	format, user, pass := out.Format, out.Username, out.Password
+	if format != "" && !provider.IsTemplate(format) {
+		// The older "user:pass-%s" form only carries the account.
+		account, _, _ := strings.Cut(format, "-")
+		var ok bool
+		user, pass, ok = strings.Cut(account, ":")
+		if !ok {
+			return nil, fmt.Errorf("upstream format for %s has no password", out.Domain)
+		}
+		format = ""
+	}
+	if format == "" {
+		format = provider.Lookup(pool.Provider).Template
+	}
+
+	tmpl, err := provider.ParseTemplate(format)
+	if err != nil {
+		return nil, fmt.Errorf("upstream format for %s: %w", out.Domain, err)
+	}
+	if f.Sticky() {
+		f = sticky.filters(provider.Lookup(pool.Provider), tmpl, f)
+	}
+
+	username, password, err := tmpl.Render(user, pass, f)
+	if err != nil {
+		return nil, err
+	}
+
+	scheme := out.Protocol
+	if scheme == "" {
+		scheme = schema.ProtocolHTTP
+	}
+
+	return &url.URL{
+		Scheme: scheme,
+		User:   url.UserPassword(username, password),
+		Host:   net.JoinHostPort(out.Domain, strconv.Itoa(pool.UpstreamPort(out))),
+	}, nil
+}
+
+// dialUpstream opens a connection to dest tunnelled through the upstream
+// proxy u, using HTTP CONNECT or SOCKS5 depending on its scheme. The
+// handshake must finish by deadline. It also returns the address a SOCKS5
+// upstream bound for the connection; HTTP upstreams do not report one.
+func dialUpstream(u *url.URL, dest string, deadline time.Time) (net.Conn, string, error) {
+	conn, err := net.DialTimeout("tcp", u.Host, time.Until(deadline))
+	if err != nil {
+		return nil, "", err
+	}
+
+	conn.SetDeadline(deadline)
+
+	var bound string
+	switch u.Scheme {
+	case schema.ProtocolSOCKS5:
+		bound, err = socks5Connect(conn, u.User, dest)
+	default:
+		conn, err = httpConnect(conn, u.User, dest)
+	}
+	if err != nil {
+		conn.Close()
+		return nil, "", err
+	}
+
+	conn.SetDeadline(time.Time{})
+	return conn, bound, nil
+}
+
+func httpConnect(conn net.Conn, user *url.Userinfo, dest string) (net.Conn, error) {
+	connectReq := "CONNECT " + dest + " HTTP/1.1\r\nHost: " + dest + "\r\n"
+	if user != nil {
+		password, _ := user.Password()
+		credentials := user.Username() + ":" + password
+		auth := "Proxy-Authorization: Basic " + base64.StdEncoding.EncodeToString([]byte(credentials)) + "\r\n"
+		connectReq += auth
+	}
+	connectReq += "\r\n"
+
+	if _, err := conn.Write([]byte(connectReq)); err != nil {
+		return conn, fmt.Errorf("send CONNECT: %w", err)
+	}
+
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, &http.Request{Method: http.MethodConnect})
+	if err != nil {
+		return conn, fmt.Errorf("read CONNECT reply: %w", err)
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return conn, &connectStatusError{StatusCode: resp.StatusCode, Status: resp.Status}
+	}
+
+	if br.Buffered() > 0 {
+		return &bufferedConn{Conn: conn, r: br}, nil
+	}
+	return conn, nil
+}
+
+// connectStatusError is a non-200 reply to a CONNECT sent to an HTTP
+// upstream.
+type connectStatusError struct {
+	StatusCode int
+	Status     string
+}
+
+func (e *connectStatusError) Error() string {
+	return "upstream refused CONNECT: " + e.Status
+}
+
+// bufferedConn serves bytes the upstream sent right after its CONNECT
+// reply before reading from the connection again.
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *bufferedConn) Read(p []byte) (int, error) {
+	return c.r.Read(p)
+}
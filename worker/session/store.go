@@ -0,0 +1,282 @@
+// Package session keeps the sticky sessions of a worker: which upstream
+// each of a user's session IDs is pinned to. HTTP and SOCKS clients share
+// one store, so a session keeps its exit whichever protocol it uses.
+package session
+
+import (
+	"container/list"
+	"io"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pubudu2003060/go-proxy-prototype/worker/models"
+	"github.com/pubudu2003060/go-proxy-prototype/worker/stats"
+)
+
+// KilledFor is how long a killed session's generation is remembered when
+// captain does not say, the longest a client can keep using a session ID.
+const KilledFor = 24 * time.Hour
+
+type Key struct {
+	UserID  string
+	Session string
+}
+
+// Store maps sessions to upstreams. Entries expire with the lifetime the
+// client asked for, and once MaxSessions are held the least recently used
+// session is dropped to make room.
+type Store struct {
+	// MaxSessions caps the sessions held; 0 means no cap.
+	MaxSessions int
+	// DefaultLifetime applies to sessions that do not ask for one.
+	DefaultLifetime time.Duration
+
+	stats   *stats.Stats
+	entries map[Key]*list.Element
+	lru     *list.List // front is most recently used
+	killed  map[Key]*killed
+	mu      sync.Mutex
+}
+
+type entry struct {
+	key      Key
+	upstream string
+	country  string
+	created  time.Time
+	expires  time.Time
+	bytes    atomic.Int64 // added to without mu
+	conns    map[io.Closer]struct{}
+}
+
+// killed is the generation captain gave a session when it last killed
+// it, so that the next use of its ID asks the upstream for a new exit.
+type killed struct {
+	generation int
+	expires    time.Time
+}
+
+func NewStore(stats *stats.Stats) *Store {
+	return &Store{
+		MaxSessions:     100000,
+		DefaultLifetime: 30 * time.Minute,
+		stats:           stats,
+		entries:         make(map[Key]*list.Element),
+		lru:             list.New(),
+		killed:          make(map[Key]*killed),
+	}
+}
+
+// Start drops expired sessions every interval. Get ignores them anyway;
+// this only frees the memory and keeps the session count accurate.
+func (s *Store) Start(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		s.sweep()
+	}
+}
+
+func (s *Store) sweep() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	for _, el := range s.entries {
+		if now.After(el.Value.(*entry).expires) {
+			s.remove(el)
+		}
+	}
+	for key, k := range s.killed {
+		if now.After(k.expires) {
+			delete(s.killed, key)
+		}
+	}
+}
+
+// Get returns the upstream key is pinned to.
+func (s *Store) Get(key Key) (string, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	el, ok := s.entries[key]
+	if !ok {
+		return "", false
+	}
+	e := el.Value.(*entry)
+	if time.Now().After(e.expires) {
+		s.remove(el)
+		return "", false
+	}
+
+	s.lru.MoveToFront(el)
+	return e.upstream, true
+}
+
+// Set pins key to upstream. A new session expires after lifetime, or
+// DefaultLifetime when that is zero; moving a live session to another
+// upstream keeps its expiry.
+func (s *Store) Set(key Key, upstream, country string, lifetime time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	if el, ok := s.entries[key]; ok {
+		e := el.Value.(*entry)
+		if !now.After(e.expires) {
+			e.upstream = upstream
+			s.lru.MoveToFront(el)
+			return
+		}
+		s.remove(el)
+	}
+
+	if lifetime <= 0 {
+		lifetime = s.DefaultLifetime
+	}
+	s.entries[key] = s.lru.PushFront(&entry{
+		key:      key,
+		upstream: upstream,
+		country:  country,
+		created:  now,
+		expires:  now.Add(lifetime),
+		conns:    make(map[io.Closer]struct{}),
+	})
+	s.stats.SessionStarted()
+
+	for s.MaxSessions > 0 && s.lru.Len() > s.MaxSessions {
+		s.remove(s.lru.Back())
+	}
+}
+
+func (s *Store) remove(el *list.Element) {
+	s.lru.Remove(el)
+	delete(s.entries, el.Value.(*entry).key)
+	s.stats.SessionEnded()
+}
+
+// Track counts conn as open in the session key until the returned done is
+// called, so Kill can close it. add counts the bytes conn carries as they
+// pass, so live sessions show their traffic before it ends. Connections
+// of sessions the store does not hold are not tracked.
+func (s *Store) Track(key Key, conn io.Closer) (add func(bytes int64), done func()) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	el, ok := s.entries[key]
+	if !ok {
+		return func(int64) {}, func() {}
+	}
+	e := el.Value.(*entry)
+	e.conns[conn] = struct{}{}
+
+	add = func(bytes int64) {
+		e.bytes.Add(bytes)
+	}
+	done = func() {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+
+		delete(e.conns, conn)
+	}
+	return add, done
+}
+
+// Kill moves the session key to generation, which Generation reports so
+// that reusing the ID gets a fresh exit, and drops the session and closes
+// its open connections. Generations come from captain, which counts the
+// kills; a generation the store already has is ignored, so a kill that
+// arrives both as an event and in a heartbeat reply is applied once.
+// expires is when the generation may be forgotten.
+func (s *Store) Kill(key Key, generation int, expires time.Time) int {
+	s.mu.Lock()
+
+	k, ok := s.killed[key]
+	if !ok {
+		k = &killed{}
+		s.killed[key] = k
+	}
+	if expires.After(k.expires) {
+		k.expires = expires
+	}
+	if generation <= k.generation {
+		s.mu.Unlock()
+		return 0
+	}
+	k.generation = generation
+
+	var conns []io.Closer
+	if el, ok := s.entries[key]; ok {
+		for conn := range el.Value.(*entry).conns {
+			conns = append(conns, conn)
+		}
+		s.remove(el)
+	}
+	s.mu.Unlock()
+
+	for _, conn := range conns {
+		conn.Close()
+	}
+	return len(conns)
+}
+
+// Sync applies the killed sessions captain reports, killing any this
+// worker has not seen the latest kill of. It returns the connections it
+// closed.
+func (s *Store) Sync(killed []models.KilledSession) int {
+	closed := 0
+	for _, k := range killed {
+		closed += s.Kill(Key{UserID: k.UserID, Session: k.Session}, k.Generation, k.ExpiresAt)
+	}
+	return closed
+}
+
+// Generation returns how often key has been killed recently, 0 when never.
+func (s *Store) Generation(key Key) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if k, ok := s.killed[key]; ok {
+		return k.generation
+	}
+	return 0
+}
+
+// Snapshot returns the live sessions, oldest first.
+func (s *Store) Snapshot() []models.ActiveSession {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	sessions := make([]models.ActiveSession, 0, len(s.entries))
+	for _, el := range s.entries {
+		e := el.Value.(*entry)
+		if now.After(e.expires) {
+			continue
+		}
+		sessions = append(sessions, models.ActiveSession{
+			UserID:      e.key.UserID,
+			Session:     e.key.Session,
+			Upstream:    e.upstream,
+			Country:     e.country,
+			CreatedAt:   e.created,
+			ExpiresAt:   e.expires,
+			Bytes:       e.bytes.Load(),
+			Connections: len(e.conns),
+		})
+	}
+	sort.Slice(sessions, func(i, j int) bool {
+		return sessions[i].CreatedAt.Before(sessions[j].CreatedAt)
+	})
+
+	return sessions
+}
+
+func (s *Store) Len() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.lru.Len()
+}
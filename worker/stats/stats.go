@@ -0,0 +1,67 @@
+package stats
+
+import "sync/atomic"
+
+// Stats holds the live traffic counters of a worker. All methods are safe
+// for concurrent use.
+type Stats struct {
+	activeConns atomic.Int64
+	bytesIn     atomic.Int64
+	bytesOut    atomic.Int64
+	retries     atomic.Int64
+	sessions    atomic.Int64
+}
+
+type Snapshot struct {
+	ActiveConnections int64 `json:"active_connections"`
+	BytesIn           int64 `json:"bytes_in"`
+	BytesOut          int64 `json:"bytes_out"`
+	UpstreamRetries   int64 `json:"upstream_retries"`
+	StickySessions    int64 `json:"sticky_sessions"`
+}
+
+func New() *Stats {
+	return &Stats{}
+}
+
+func (s *Stats) ConnOpened() {
+	s.activeConns.Add(1)
+}
+
+func (s *Stats) ConnClosed() {
+	s.activeConns.Add(-1)
+}
+
+// AddIn records bytes sent from clients towards upstreams.
+func (s *Stats) AddIn(n int64) {
+	s.bytesIn.Add(n)
+}
+
+// AddOut records bytes sent from upstreams back to clients.
+func (s *Stats) AddOut(n int64) {
+	s.bytesOut.Add(n)
+}
+
+// UpstreamRetried records a connection retried on another upstream.
+func (s *Stats) UpstreamRetried() {
+	s.retries.Add(1)
+}
+
+// SessionStarted and SessionEnded track the sticky sessions held.
+func (s *Stats) SessionStarted() {
+	s.sessions.Add(1)
+}
+
+func (s *Stats) SessionEnded() {
+	s.sessions.Add(-1)
+}
+
+func (s *Stats) Snapshot() Snapshot {
+	return Snapshot{
+		ActiveConnections: s.activeConns.Load(),
+		BytesIn:           s.bytesIn.Load(),
+		BytesOut:          s.bytesOut.Load(),
+		UpstreamRetries:   s.retries.Load(),
+		StickySessions:    s.sessions.Load(),
+	}
+}